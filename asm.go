@@ -0,0 +1,402 @@
+package crux
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/faiface/crux/runtime"
+)
+
+// Disassemble writes the codes of the image as text, one code per line with its offset, kind
+// and operand. Operators and globals are written by their quoted names, values with their
+// types, e.g. int 42. A table is written as -> label size, where the label is placed before
+// the first code of the table. The .global lines at the top give the global index and the
+// code of each global.
+// Assemble reads the text back.
+func (img *Image) Disassemble(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	offsets := make(map[*runtime.Code]int, len(img.Codes))
+	for i := range img.Codes {
+		offsets[&img.Codes[i]] = i
+	}
+
+	labels := make(map[int]bool)
+	for i := range img.Codes {
+		if table := img.Codes[i].Table; len(table) > 0 {
+			offset, ok := offsets[&table[0]]
+			if !ok {
+				return fmt.Errorf("code %d: table outside of codes", i)
+			}
+			labels[offset] = true
+		}
+	}
+
+	names := make([]string, 0, len(img.CodeIndices))
+	for name := range img.CodeIndices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	globalNames := make(map[int32]string)
+	codeNames := make(map[int32][]string)
+	for _, name := range names {
+		for index, code := range img.CodeIndices[name] {
+			global := fmt.Sprintf("%s/%d", name, index)
+			globalNames[img.GlobalIndices[name][index]] = global
+			codeNames[code] = append(codeNames[code], global)
+			labels[int(code)] = true
+			fmt.Fprintf(bw, ".global %s %d L%d\n", strconv.Quote(global), img.GlobalIndices[name][index], code)
+		}
+	}
+
+	for i := range img.Codes {
+		code := &img.Codes[i]
+		if labels[i] {
+			fmt.Fprintf(bw, "\n")
+			for _, global := range codeNames[int32(i)] {
+				fmt.Fprintf(bw, "; %s\n", strconv.Quote(global))
+			}
+			fmt.Fprintf(bw, "L%d:\n", i)
+		}
+
+		var operand string
+		switch code.Kind {
+		case runtime.CodeValue:
+			switch value := code.Value.(type) {
+			case *runtime.Char:
+				operand = "char " + strconv.QuoteRune(value.Value)
+			case *runtime.Int:
+				operand = "int " + value.Value.String()
+			case *runtime.Float:
+				operand = "float " + strconv.FormatFloat(value.Value, 'g', -1, 64)
+			default:
+				return fmt.Errorf("code %d: can't disassemble value %v", i, code.Value)
+			}
+		case runtime.CodeOperator:
+			if runtime.OperatorArity(code.X) < 0 {
+				return fmt.Errorf("code %d: wrong operator code %d", i, code.X)
+			}
+			operand = strconv.Quote(runtime.OperatorString[code.X])
+		case runtime.CodeGlobal:
+			global, ok := globalNames[code.X]
+			if !ok {
+				return fmt.Errorf("code %d: global %d has no name", i, code.X)
+			}
+			operand = strconv.Quote(global)
+		default:
+			operand = strconv.Itoa(int(code.X))
+		}
+
+		fmt.Fprintf(bw, "%6d  %-9s %s", i, code.Kind, operand)
+		if len(code.Table) > 0 {
+			fmt.Fprintf(bw, " -> L%d %d", offsets[&code.Table[0]], len(code.Table))
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+
+	return bw.Flush()
+}
+
+type asmGlobal struct {
+	name   string
+	index  int
+	global int32
+	label  string
+	line   int
+	full   string
+}
+
+type asmCode struct {
+	kind    runtime.CodeKind
+	operand []string
+	label   string
+	size    int
+	line    int
+}
+
+// Assemble parses the text written by Disassemble into an image. Offsets at the start of the
+// lines are optional and only checked, labels may be any names ending with a colon and
+// everything after a semicolon is a comment.
+func Assemble(r io.Reader) (*Image, error) {
+	kinds := make(map[string]runtime.CodeKind)
+	for kind := runtime.CodeKind(0); kind.Valid(); kind++ {
+		kinds[kind.String()] = kind
+	}
+
+	var (
+		globals []asmGlobal
+		codes   []asmCode
+		labels  = make(map[string]int)
+	)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields, err := asmFields(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == ".global" {
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("line %d: expected .global name/index global label", line)
+			}
+			slash := strings.LastIndexByte(fields[1], '/')
+			if slash < 0 {
+				return nil, fmt.Errorf("line %d: missing overload index in %s", line, fields[1])
+			}
+			index, err := strconv.Atoi(fields[1][slash+1:])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("line %d: invalid overload index in %s", line, fields[1])
+			}
+			global, err := strconv.ParseInt(fields[2], 10, 32)
+			if err != nil || global < 0 {
+				return nil, fmt.Errorf("line %d: invalid global index %s", line, fields[2])
+			}
+			globals = append(globals, asmGlobal{
+				name:   fields[1][:slash],
+				index:  index,
+				global: int32(global),
+				label:  fields[3],
+				line:   line,
+				full:   fields[1],
+			})
+			continue
+		}
+
+		if len(fields) == 1 && strings.HasSuffix(fields[0], ":") {
+			label := strings.TrimSuffix(fields[0], ":")
+			if _, ok := labels[label]; ok {
+				return nil, fmt.Errorf("line %d: label %s defined twice", line, label)
+			}
+			labels[label] = len(codes)
+			continue
+		}
+
+		if offset, err := strconv.Atoi(fields[0]); err == nil {
+			if offset != len(codes) {
+				return nil, fmt.Errorf("line %d: offset %d, expected %d", line, offset, len(codes))
+			}
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %d: missing kind", line)
+		}
+		kind, ok := kinds[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown kind %s", line, fields[0])
+		}
+		code := asmCode{kind: kind, operand: fields[1:], line: line}
+		if n := len(code.operand); n >= 3 && code.operand[n-3] == "->" {
+			size, err := strconv.Atoi(code.operand[n-1])
+			if err != nil || size <= 0 {
+				return nil, fmt.Errorf("line %d: invalid table size %s", line, code.operand[n-1])
+			}
+			code.label, code.size = code.operand[n-2], size
+			code.operand = code.operand[:n-3]
+		}
+		codes = append(codes, code)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		GlobalIndices: make(map[string][]int32),
+		CodeIndices:   make(map[string][]int32),
+		Codes:         make([]runtime.Code, len(codes)),
+	}
+
+	resolve := func(line int, label string) (int, error) {
+		offset, ok := labels[label]
+		if !ok {
+			return 0, fmt.Errorf("line %d: label %s not defined", line, label)
+		}
+		return offset, nil
+	}
+
+	sort.SliceStable(globals, func(i, j int) bool {
+		if globals[i].name != globals[j].name {
+			return globals[i].name < globals[j].name
+		}
+		return globals[i].index < globals[j].index
+	})
+	globalIndices := make(map[string]int32)
+	numGlobals := 0
+	for _, g := range globals {
+		if g.index != len(img.GlobalIndices[g.name]) {
+			return nil, fmt.Errorf("line %d: %s out of order or defined twice", g.line, g.full)
+		}
+		offset, err := resolve(g.line, g.label)
+		if err != nil {
+			return nil, err
+		}
+		if offset >= len(codes) {
+			return nil, fmt.Errorf("line %d: label %s after the last code", g.line, g.label)
+		}
+		img.GlobalIndices[g.name] = append(img.GlobalIndices[g.name], g.global)
+		img.CodeIndices[g.name] = append(img.CodeIndices[g.name], int32(offset))
+		globalIndices[g.full] = g.global
+		if int(g.global) >= numGlobals {
+			numGlobals = int(g.global) + 1
+		}
+	}
+
+	for i, c := range codes {
+		code := &img.Codes[i]
+		code.Kind = c.kind
+
+		if c.label != "" {
+			offset, err := resolve(c.line, c.label)
+			if err != nil {
+				return nil, err
+			}
+			if offset+c.size > len(codes) {
+				return nil, fmt.Errorf("line %d: table outside of codes", c.line)
+			}
+			code.Table = img.Codes[offset : offset+c.size]
+		}
+
+		switch c.kind {
+		case runtime.CodeValue:
+			if len(c.operand) != 2 {
+				return nil, fmt.Errorf("line %d: expected type and value", c.line)
+			}
+			value, err := asmValue(c.operand[0], c.operand[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", c.line, err)
+			}
+			code.Value = value
+			continue
+		case runtime.CodeOperator:
+			if len(c.operand) != 1 {
+				return nil, fmt.Errorf("line %d: expected operator name", c.line)
+			}
+			op, ok := runtime.OperatorCode(c.operand[0])
+			if !ok {
+				return nil, fmt.Errorf("line %d: no operator named %s", c.line, c.operand[0])
+			}
+			code.X = op
+			continue
+		case runtime.CodeGlobal:
+			if len(c.operand) != 1 {
+				return nil, fmt.Errorf("line %d: expected global name", c.line)
+			}
+			global, ok := globalIndices[c.operand[0]]
+			if !ok {
+				return nil, fmt.Errorf("line %d: global %s not defined", c.line, c.operand[0])
+			}
+			code.X = global
+			continue
+		}
+
+		if len(c.operand) != 1 {
+			return nil, fmt.Errorf("line %d: expected one operand", c.line)
+		}
+		x, err := strconv.ParseInt(c.operand[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid operand %s", c.line, c.operand[0])
+		}
+		code.X = int32(x)
+	}
+
+	img.GlobalValues = make([]runtime.Value, numGlobals)
+	for _, g := range globals {
+		if img.GlobalValues[g.global] != nil {
+			return nil, fmt.Errorf("line %d: global %d defined twice", g.line, g.global)
+		}
+		offset, _ := resolve(g.line, g.label)
+		img.GlobalValues[g.global] = globalValue(&img.Codes[offset])
+	}
+
+	if err := img.check(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func asmValue(typ, s string) (runtime.Value, error) {
+	switch typ {
+	case "char":
+		str, err := strconv.Unquote(s)
+		if err != nil || s[0] != '\'' {
+			return nil, fmt.Errorf("invalid char %s", s)
+		}
+		r, _ := utf8.DecodeRuneInString(str)
+		return &runtime.Char{Value: r}, nil
+	case "int":
+		i := &runtime.Int{}
+		if _, ok := i.Value.SetString(s, 10); !ok {
+			return nil, fmt.Errorf("invalid int %s", s)
+		}
+		return i, nil
+	case "float":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float %s", s)
+		}
+		return &runtime.Float{Value: f}, nil
+	default:
+		return nil, fmt.Errorf("unknown value type %s", typ)
+	}
+}
+
+// asmFields splits a line into fields separated by spaces, keeping quoted chars together,
+// unquoting quoted names and dropping comments.
+func asmFields(line string) ([]string, error) {
+	var fields []string
+	for i := 0; i < len(line); {
+		switch {
+		case line[i] == ' ' || line[i] == '\t' || line[i] == '\r':
+			i++
+		case line[i] == ';':
+			return fields, nil
+		case line[i] == '\'':
+			j := i + 1
+			for j < len(line) && line[j] != '\'' {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated char %s", line[i:])
+			}
+			fields = append(fields, line[i:j+1])
+			i = j + 1
+		case line[i] == '"':
+			j := i + 1
+			for j < len(line) && line[j] != '"' {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated name %s", line[i:])
+			}
+			name, err := strconv.Unquote(line[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid name %s", line[i:j+1])
+			}
+			fields = append(fields, name)
+			i = j + 1
+		default:
+			j := i
+			for j < len(line) && line[j] != ' ' && line[j] != '\t' && line[j] != '\r' {
+				j++
+			}
+			fields = append(fields, line[i:j])
+			i = j
+		}
+	}
+	return fields, nil
+}
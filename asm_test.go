@@ -0,0 +1,39 @@
+package crux_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/faiface/crux"
+	"github.com/faiface/crux/mk"
+	"github.com/faiface/crux/runtime"
+)
+
+func TestAssembleDisassembled(t *testing.T) {
+	globals := map[string][]crux.Expr{
+		";":         {mk.Abst("x", "y")(mk.Var("y", -1))},
+		"two words": {mk.Int(40)},
+		"main": {mk.Appl(mk.Var(";", 0), mk.Char(';'),
+			mk.Appl(mk.OpNamed("+/int"), mk.Var("two words", 0), mk.Int(2)))},
+	}
+	globalIndices, globalValues, codeIndices, codes := crux.Compile(globals)
+	img := &crux.Image{
+		GlobalIndices: globalIndices,
+		GlobalValues:  globalValues,
+		CodeIndices:   codeIndices,
+		Codes:         codes,
+	}
+
+	var text bytes.Buffer
+	if err := img.Disassemble(&text); err != nil {
+		t.Fatal(err)
+	}
+	assembled, err := crux.Assemble(&text)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, text.String())
+	}
+	result := runtime.Reduce(assembled.GlobalValues, assembled.GlobalValues[assembled.GlobalIndices["main"][0]])
+	if i, ok := result.(*runtime.Int); !ok || i.Value.Int64() != 42 {
+		t.Errorf("main reduced to %v, want 42", result)
+	}
+}
@@ -2,6 +2,8 @@ package crux
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/faiface/crux/runtime"
 )
@@ -11,28 +13,16 @@ type link struct {
 	Index int32
 }
 
+// isFast tells whether an abstraction with this body can reuse its data slice. Thunks only
+// capture copies of the variables they need, so the data must only not outlive the body.
 func isFast(e Expr) bool {
 	switch e := e.(type) {
 	case *Char, *Int, *Float, *Operator, *Make, *Field, *Var, *Abst:
 		return true
 	case *Appl:
-		switch e.Rator.(type) {
-		case *Operator:
-			return true
-		}
-		if !isFast(e.Rator) {
-			return false
-		}
-		for _, rand := range e.Rands {
-			switch rand := rand.(type) {
-			case *Var, *Strict:
-				continue
-			default:
-				if hasLocals(rand) {
-					return false
-				}
-			}
-		}
+		return isFast(e.Rator)
+	case *Let, *LetRec:
+		// the body gets a fresh data slice
 		return true
 	case *Switch:
 		for _, cas := range e.Cases {
@@ -40,57 +30,79 @@ func isFast(e Expr) bool {
 				return false
 			}
 		}
-		return true
+		return e.Default == nil || isFast(e.Default)
+	case *Match:
+		for _, cas := range e.Cases {
+			if !isFast(cas) {
+				return false
+			}
+		}
+		return e.Default == nil || isFast(e.Default)
+	case *Strict:
+		return isFast(e.Expr)
+	case *Annotated:
+		return isFast(e.Expr)
 	default:
 		panic("unreachable")
 	}
 }
 
-func hasLocals(e Expr) bool {
-	switch e := e.(type) {
-	case *Char, *Int, *Float, *Operator, *Make, *Field:
-		return false
-	case *Var:
-		return e.Index < 0
-	case *Abst:
-		return false
-	case *Appl:
-		if hasLocals(e.Rator) {
-			return true
+func compareKeys(x, y Expr) int {
+	switch x := x.(type) {
+	case *Char:
+		y, ok := y.(*Char)
+		if !ok {
+			panic("match keys must all be chars or all ints")
 		}
-		for _, rand := range e.Rands {
-			if hasLocals(rand) {
-				return true
-			}
+		switch {
+		case x.Value < y.Value:
+			return -1
+		case x.Value > y.Value:
+			return +1
+		default:
+			return 0
 		}
-		return false
-	case *Strict:
-		return hasLocals(e.Expr)
-	case *Switch:
-		if hasLocals(e.Expr) {
-			return true
+	case *Int:
+		y, ok := y.(*Int)
+		if !ok {
+			panic("match keys must all be chars or all ints")
 		}
-		for _, cas := range e.Cases {
-			if hasLocals(cas) {
-				return true
-			}
-		}
-		return false
+		return x.Value.Cmp(&y.Value)
 	default:
 		panic("unreachable")
 	}
 }
 
+func extend(locals []string, bound []string) []string {
+	extended := make([]string, 0, len(locals)+len(bound))
+	extended = append(extended, locals...)
+	return append(extended, bound...)
+}
+
 func Compile(globals map[string][]Expr) (
 	globalIndices map[string][]int32,
 	globalValues []runtime.Value,
 	codeIndices map[string][]int32,
 	codes []runtime.Code,
 ) {
+	if cycles := CAFCycles(globals); len(cycles) > 0 {
+		paths := make([]string, len(cycles))
+		for i := range cycles {
+			paths[i] = formatPath(cycles[i])
+		}
+		panic(fmt.Sprintf("infinite reduction, %s", strings.Join(paths, "; ")))
+	}
+
 	// total hack, compile the first time just to get the number of codes
 	// compile second time so that tables all refer the same codes slice
-	_, _, _, codes = compile(0, globals)
-	return compile(len(codes), globals)
+	_, _, _, codes, _ = compile(0, globals)
+	var sources map[int]runtime.Source
+	globalIndices, globalValues, codeIndices, codes, sources = compile(len(codes), globals)
+	for i := range sources {
+		src := sources[i]
+		codes[i].Source = &src
+	}
+	return globalIndices, globalValues, codeIndices, codes
 }
 
 func compile(alloc int, globals map[string][]Expr) (
@@ -98,19 +110,77 @@ func compile(alloc int, globals map[string][]Expr) (
 	globalValues []runtime.Value,
 	codeIndices map[string][]int32,
 	codes []runtime.Code,
+	sources map[int]runtime.Source,
 ) {
 	links := make(map[int]link)
+	sources = make(map[int]runtime.Source)
+
+	var (
+		global  string
+		pos     *runtime.Pos // innermost annotation being compiled
+		pending *runtime.Pos // annotation of the code about to be processed
+	)
 
 	var process = func(i int) func(c runtime.Code, ln *link) runtime.Code {
 		return func(c runtime.Code, ln *link) runtime.Code {
 			if ln != nil {
 				links[i] = *ln
 			}
+			p := pos
+			if pending != nil {
+				p, pending = pending, nil
+			}
+			if p != nil {
+				sources[i] = runtime.Source{Global: global, Pos: *p}
+			} else if c.Kind == runtime.CodeSwitch || c.Kind == runtime.CodeMatch {
+				sources[i] = runtime.Source{Global: global}
+			}
 			return c
 		}
 	}
 
 	var compile func(locals []string, e Expr) (runtime.Code, *link)
+
+	// closure compiles e to be reduced with only its free variables as the data
+	closure := func(locals []string, e Expr) (runtime.Code, *link) {
+		free := FreeVars(e)
+		i := len(codes)
+		codes = append(codes, make([]runtime.Code, 1+len(free))...)
+		codes[i] = process(i)(compile(free, e))
+		for j, name := range free {
+			codes[i+1+j] = process(i + 1 + j)(compile(locals, &Var{Name: name, Index: -1}))
+		}
+		return runtime.Code{
+			Kind:  runtime.CodeClosure,
+			X:     int32(len(free)),
+			Table: codes[i : i+1+len(free)],
+		}, nil
+	}
+
+	// deferred compiles an expression that becomes a thunk, capturing only its free variables
+	deferred := func(locals []string, e Expr) (runtime.Code, *link) {
+		switch inner := Unannotate(e).(type) {
+		case *Char, *Int, *Float, *Var, *Strict:
+			return compile(locals, e)
+		case *Appl:
+			// a projection of a local struct becomes a selector thunk
+			field, ok := Unannotate(inner.Rator).(*Field)
+			if ok && len(inner.Rands) == 1 {
+				if v, ok := Unannotate(inner.Rands[0]).(*Var); ok && v.Index < 0 {
+					i := len(codes)
+					codes = append(codes, runtime.Code{})
+					codes[i] = process(i)(compile(locals, v))
+					return runtime.Code{
+						Kind:  runtime.CodeSelect,
+						X:     field.Index,
+						Table: codes[i : i+1],
+					}, nil
+				}
+			}
+		}
+		return closure(locals, e)
+	}
+
 	compile = func(locals []string, e Expr) (runtime.Code, *link) {
 		switch e := e.(type) {
 		case *Char:
@@ -182,13 +252,57 @@ func compile(alloc int, globals map[string][]Expr) (
 			codes = append(codes, make([]runtime.Code, 1+len(e.Rands))...)
 			codes[i] = process(i)(compile(locals, e.Rator))
 			for j := 0; j < len(e.Rands); j++ {
-				codes[i+1+j] = process(i + 1 + j)(compile(locals, e.Rands[j]))
+				codes[i+1+j] = process(i + 1 + j)(deferred(locals, e.Rands[j]))
 			}
 			return runtime.Code{
 				Kind:  runtime.CodeAppl,
 				Table: codes[i : i+1+len(e.Rands)],
 			}, nil
 
+		case *Let:
+			i := len(codes)
+			codes = append(codes, make([]runtime.Code, 1+len(e.Values))...)
+			codes[i] = process(i)(compile(extend(locals, e.Bound), e.Body))
+			for j := 0; j < len(e.Values); j++ {
+				codes[i+1+j] = process(i + 1 + j)(deferred(locals, e.Values[j]))
+			}
+			return runtime.Code{
+				Kind:  runtime.CodeLet,
+				X:     int32(len(e.Values)),
+				Table: codes[i : i+1+len(e.Values)],
+			}, nil
+
+		case *LetRec:
+			i := len(codes)
+			codes = append(codes, make([]runtime.Code, 1+len(e.Values))...)
+			recLocals := extend(locals, e.Bound)
+			codes[i] = process(i)(compile(recLocals, e.Body))
+			for j := 0; j < len(e.Values); j++ {
+				switch Unannotate(e.Values[j]).(type) {
+				case *Strict:
+					panic("strict value in a recursive binding")
+				case *Char, *Int, *Float, *Var:
+					codes[i+1+j] = process(i + 1 + j)(compile(recLocals, e.Values[j]))
+				default:
+					codes[i+1+j] = process(i + 1 + j)(closure(recLocals, e.Values[j]))
+				}
+			}
+			return runtime.Code{
+				Kind:  runtime.CodeLetRec,
+				X:     int32(len(e.Values)),
+				Table: codes[i : i+1+len(e.Values)],
+			}, nil
+
+		case *Annotated:
+			outer := pos
+			pos = &e.Pos
+			c, ln := compile(locals, e.Expr)
+			pos = outer
+			if pending == nil {
+				pending = &e.Pos
+			}
+			return c, ln
+
 		case *Strict:
 			i := len(codes)
 			codes = append(codes, runtime.Code{})
@@ -199,15 +313,62 @@ func compile(alloc int, globals map[string][]Expr) (
 			}, nil
 
 		case *Switch:
+			size := 1 + len(e.Cases)
+			if e.Default != nil {
+				size++
+			}
 			i := len(codes)
-			codes = append(codes, make([]runtime.Code, 1+len(e.Cases))...)
+			codes = append(codes, make([]runtime.Code, size)...)
 			codes[i] = process(i)(compile(locals, e.Expr))
 			for j := 0; j < len(e.Cases); j++ {
 				codes[i+1+j] = process(i + 1 + j)(compile(locals, e.Cases[j]))
 			}
+			if e.Default != nil {
+				codes[i+1+len(e.Cases)] = process(i + 1 + len(e.Cases))(compile(locals, e.Default))
+			}
 			return runtime.Code{
 				Kind:  runtime.CodeSwitch,
-				Table: codes[i : i+1+len(e.Cases)],
+				X:     int32(len(e.Cases)),
+				Table: codes[i : i+size],
+			}, nil
+
+		case *Match:
+			order := make([]int, len(e.Keys))
+			for j := range order {
+				switch e.Keys[j].(type) {
+				case *Char, *Int:
+				default:
+					panic(fmt.Sprintf("%v is not a valid match key", e.Keys[j]))
+				}
+				order[j] = j
+			}
+			sort.Slice(order, func(a, b int) bool {
+				return compareKeys(e.Keys[order[a]], e.Keys[order[b]]) < 0
+			})
+			for j := 1; j < len(order); j++ {
+				if compareKeys(e.Keys[order[j-1]], e.Keys[order[j]]) == 0 {
+					panic(fmt.Sprintf("duplicate key %v in match", e.Keys[order[j]]))
+				}
+			}
+			n := len(e.Keys)
+			size := 1 + 2*n
+			if e.Default != nil {
+				size++
+			}
+			i := len(codes)
+			codes = append(codes, make([]runtime.Code, size)...)
+			codes[i] = process(i)(compile(locals, e.Expr))
+			for j, k := range order {
+				codes[i+1+j] = process(i + 1 + j)(compile(locals, e.Keys[k]))
+				codes[i+1+n+j] = process(i + 1 + n + j)(compile(locals, e.Cases[k]))
+			}
+			if e.Default != nil {
+				codes[i+1+2*n] = process(i + 1 + 2*n)(compile(locals, e.Default))
+			}
+			return runtime.Code{
+				Kind:  runtime.CodeMatch,
+				X:     int32(n),
+				Table: codes[i : i+size],
 			}, nil
 		}
 		panic("unreachable")
@@ -221,10 +382,14 @@ func compile(alloc int, globals map[string][]Expr) (
 	for name := range globals {
 		for index := range globals[name] {
 			i := len(codes)
+			global = fmt.Sprintf("%s/%d", name, index)
 
 			codeIndices[name] = append(codeIndices[name], int32(len(codes)))
 			codes = append(codes, runtime.Code{})
 			codes[i] = process(i)(compile(nil, globals[name][index]))
+			if _, ok := sources[i]; !ok {
+				sources[i] = runtime.Source{Global: global}
+			}
 
 			globalIndices[name] = append(globalIndices[name], int32(len(globalValues)))
 			switch codes[i].Kind {
@@ -243,5 +408,5 @@ func compile(alloc int, globals map[string][]Expr) (
 		}
 	}
 
-	return globalIndices, globalValues, codeIndices, codes
+	return globalIndices, globalValues, codeIndices, codes, sources
 }
@@ -0,0 +1,63 @@
+package crux_test
+
+import (
+	"testing"
+
+	"github.com/faiface/crux"
+	"github.com/faiface/crux/mk"
+	"github.com/faiface/crux/runtime"
+)
+
+// firstField reduces main, which must give a struct, and returns its first field along with
+// the values of the globals.
+func firstField(t *testing.T, globals map[string][]crux.Expr) (runtime.Value, map[string][]int32, []runtime.Value) {
+	t.Helper()
+	globalIndices, globalValues, _, _ := crux.Compile(globals)
+	str, ok := runtime.Reduce(globalValues, globalValues[globalIndices["main"][0]]).(*runtime.Struct)
+	if !ok || len(str.Values) == 0 {
+		t.Fatal("main didn't reduce to a struct with fields")
+	}
+	return str.Values[len(str.Values)-1], globalIndices, globalValues
+}
+
+func TestThunksCaptureFreeVariables(t *testing.T) {
+	x := mk.Var("x", -1)
+	inc := mk.Appl(mk.OpNamed("+/int"), x, mk.Int(1))
+
+	tests := []struct {
+		name string
+		fn   crux.Expr
+		data int
+	}{
+		{"rand", mk.Abst("a", "b", "x")(mk.Appl(mk.Make(0), inc)), 1},
+		{"let", mk.Abst("a", "b", "x")(mk.Bind([]string{"y"}, inc)(mk.Appl(mk.Make(0), mk.Var("y", -1)))), 1},
+		{"letrec", mk.Abst("a", "b", "x")(mk.BindRec([]string{"xs"}, mk.Appl(mk.Make(0), x, mk.Var("xs", -1)))(mk.Appl(mk.Make(0), mk.Var("xs", -1)))), 2},
+	}
+	for _, test := range tests {
+		globals := map[string][]crux.Expr{
+			"f":    {test.fn},
+			"main": {mk.Appl(mk.Var("f", 0), mk.Int(1), mk.Int(2), mk.Int(3))},
+		}
+		value, _, _ := firstField(t, globals)
+		thunk, ok := value.(*runtime.Thunk)
+		if !ok {
+			t.Errorf("%s: field is %T, not a thunk", test.name, value)
+			continue
+		}
+		if len(thunk.Data) != test.data {
+			t.Errorf("%s: thunk holds %d values, want %d", test.name, len(thunk.Data), test.data)
+		}
+	}
+}
+
+func TestGlobalArgumentsAreShared(t *testing.T) {
+	globals := map[string][]crux.Expr{
+		"g":    {mk.Appl(mk.OpNamed("+/int"), mk.Int(1), mk.Int(2))},
+		"f":    {mk.Abst("a", "b")(mk.Appl(mk.Make(0), mk.Var("g", 0)))},
+		"main": {mk.Appl(mk.Var("f", 0), mk.Int(1), mk.Int(2))},
+	}
+	value, globalIndices, globalValues := firstField(t, globals)
+	if value != globalValues[globalIndices["g"][0]] {
+		t.Errorf("field is %v, not the value of g/0", value)
+	}
+}
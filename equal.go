@@ -0,0 +1,285 @@
+package crux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"math"
+
+	"github.com/faiface/crux/runtime"
+)
+
+// Equal tells whether a and b are structurally identical, including the names of bound
+// variables and annotations. Char and Int values are never equal to each other.
+func Equal(a, b Expr) bool {
+	switch a := a.(type) {
+	case *Char:
+		b, ok := b.(*Char)
+		return ok && a.Value == b.Value
+	case *Int:
+		b, ok := b.(*Int)
+		return ok && a.Value.Cmp(&b.Value) == 0
+	case *Float:
+		b, ok := b.(*Float)
+		return ok && math.Float64bits(a.Value) == math.Float64bits(b.Value)
+	case *Operator:
+		b, ok := b.(*Operator)
+		return ok && a.Code == b.Code
+	case *Make:
+		b, ok := b.(*Make)
+		return ok && a.Index == b.Index
+	case *Field:
+		b, ok := b.(*Field)
+		return ok && a.Index == b.Index
+	case *Var:
+		b, ok := b.(*Var)
+		return ok && a.Name == b.Name && a.Index == b.Index
+	case *Abst:
+		b, ok := b.(*Abst)
+		return ok && equalNames(a.Bound, b.Bound) && Equal(a.Body, b.Body)
+	case *Appl:
+		b, ok := b.(*Appl)
+		return ok && Equal(a.Rator, b.Rator) && equalAll(a.Rands, b.Rands)
+	case *Let:
+		b, ok := b.(*Let)
+		return ok && equalNames(a.Bound, b.Bound) && equalAll(a.Values, b.Values) && Equal(a.Body, b.Body)
+	case *LetRec:
+		b, ok := b.(*LetRec)
+		return ok && equalNames(a.Bound, b.Bound) && equalAll(a.Values, b.Values) && Equal(a.Body, b.Body)
+	case *Strict:
+		b, ok := b.(*Strict)
+		return ok && Equal(a.Expr, b.Expr)
+	case *Annotated:
+		b, ok := b.(*Annotated)
+		return ok && a.Pos == b.Pos && Equal(a.Expr, b.Expr)
+	case *Switch:
+		b, ok := b.(*Switch)
+		return ok && Equal(a.Expr, b.Expr) && equalAll(a.Cases, b.Cases) && equalOptional(a.Default, b.Default)
+	case *Match:
+		b, ok := b.(*Match)
+		return ok && Equal(a.Expr, b.Expr) && equalAll(a.Keys, b.Keys) && equalAll(a.Cases, b.Cases) &&
+			equalOptional(a.Default, b.Default)
+	default:
+		panic(fmt.Sprintf("unknown expression %T", a))
+	}
+}
+
+func equalNames(as, bs []string) bool {
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalAll(as, bs []Expr) bool {
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := range as {
+		if !Equal(as[i], bs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalOptional(a, b Expr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return Equal(a, b)
+}
+
+// Hash returns a hash of e consistent with Equal. It only depends on the structure of e, so
+// it's the same across runs and can be used for content-addressed caching. Operators are
+// hashed by their names.
+func Hash(e Expr) uint64 {
+	h := &hasher{h: fnv.New64a()}
+	h.expr(e, nil)
+	return h.h.Sum64()
+}
+
+// AlphaHash returns a hash of e consistent with AlphaEqual, it doesn't depend on the names
+// of bound variables, nor on annotations.
+func AlphaHash(e Expr) uint64 {
+	h := &hasher{h: fnv.New64a(), alpha: true}
+	h.expr(e, nil)
+	return h.h.Sum64()
+}
+
+type hasher struct {
+	h     hash.Hash64
+	alpha bool
+	buf   [binary.MaxVarintLen64]byte
+}
+
+func (h *hasher) int(x int64) {
+	n := binary.PutVarint(h.buf[:], x)
+	h.h.Write(h.buf[:n])
+}
+
+func (h *hasher) string(s string) {
+	h.int(int64(len(s)))
+	h.h.Write([]byte(s))
+}
+
+func (h *hasher) binder(bound []string) {
+	h.int(int64(len(bound)))
+	if !h.alpha {
+		for _, name := range bound {
+			h.string(name)
+		}
+	}
+}
+
+func (h *hasher) exprs(es []Expr, bound []string) {
+	h.int(int64(len(es)))
+	for _, e := range es {
+		h.expr(e, bound)
+	}
+}
+
+func (h *hasher) expr(e Expr, bound []string) {
+	if a, ok := e.(*Annotated); ok && h.alpha {
+		h.expr(a.Expr, bound)
+		return
+	}
+
+	switch e := e.(type) {
+	case nil:
+		h.int(0)
+	case *Char:
+		h.int(1)
+		h.int(int64(e.Value))
+	case *Int:
+		h.int(2)
+		h.int(int64(e.Value.Sign()))
+		bytes := e.Value.Bytes()
+		h.int(int64(len(bytes)))
+		h.h.Write(bytes)
+	case *Float:
+		h.int(3)
+		h.int(int64(math.Float64bits(e.Value)))
+	case *Operator:
+		h.int(4)
+		if runtime.OperatorArity(e.Code) < 0 {
+			h.string(fmt.Sprint(e.Code))
+		} else {
+			h.string(e.String())
+		}
+	case *Make:
+		h.int(5)
+		h.int(int64(e.Index))
+	case *Field:
+		h.int(6)
+		h.int(int64(e.Index))
+	case *Var:
+		h.int(7)
+		h.int(int64(e.Index))
+		if e.Index < 0 && h.alpha {
+			if i := lastIndex(bound, e.Name); i >= 0 {
+				h.int(int64(i))
+				return
+			}
+			h.int(-1)
+		}
+		h.string(e.Name)
+	case *Abst:
+		h.int(8)
+		h.binder(e.Bound)
+		h.expr(e.Body, extend(bound, e.Bound))
+	case *Appl:
+		h.int(9)
+		h.expr(e.Rator, bound)
+		h.exprs(e.Rands, bound)
+	case *Let:
+		h.int(10)
+		h.binder(e.Bound)
+		h.exprs(e.Values, bound)
+		h.expr(e.Body, extend(bound, e.Bound))
+	case *LetRec:
+		h.int(11)
+		h.binder(e.Bound)
+		recBound := extend(bound, e.Bound)
+		h.exprs(e.Values, recBound)
+		h.expr(e.Body, recBound)
+	case *Strict:
+		h.int(12)
+		h.expr(e.Expr, bound)
+	case *Annotated:
+		h.int(13)
+		h.string(e.Pos.File)
+		h.int(int64(e.Pos.Line))
+		h.int(int64(e.Pos.Col))
+		h.expr(e.Expr, bound)
+	case *Switch:
+		h.int(14)
+		h.expr(e.Expr, bound)
+		h.exprs(e.Cases, bound)
+		h.expr(e.Default, bound)
+	case *Match:
+		h.int(15)
+		h.expr(e.Expr, bound)
+		h.exprs(e.Keys, bound)
+		h.exprs(e.Cases, bound)
+		h.expr(e.Default, bound)
+	default:
+		panic(fmt.Sprintf("unknown expression %T", e))
+	}
+}
+
+// Clone returns a deep copy of e sharing no memory with it.
+func Clone(e Expr) Expr {
+	switch e := e.(type) {
+	case nil:
+		return nil
+	case *Char:
+		return &Char{Value: e.Value}
+	case *Int:
+		c := &Int{}
+		c.Value.Set(&e.Value)
+		return c
+	case *Float:
+		return &Float{Value: e.Value}
+	case *Operator:
+		return &Operator{Code: e.Code}
+	case *Make:
+		return &Make{Index: e.Index}
+	case *Field:
+		return &Field{Index: e.Index}
+	case *Var:
+		return &Var{Name: e.Name, Index: e.Index}
+	case *Abst:
+		return &Abst{Bound: cloneNames(e.Bound), Body: Clone(e.Body)}
+	case *Let:
+		return &Let{Bound: cloneNames(e.Bound), Values: cloneAll(e.Values), Body: Clone(e.Body)}
+	case *LetRec:
+		return &LetRec{Bound: cloneNames(e.Bound), Values: cloneAll(e.Values), Body: Clone(e.Body)}
+	default:
+		return WithChildren(e, cloneAll(Children(e)))
+	}
+}
+
+func cloneNames(names []string) []string {
+	if names == nil {
+		return nil
+	}
+	return append([]string(nil), names...)
+}
+
+func cloneAll(es []Expr) []Expr {
+	if es == nil {
+		return nil
+	}
+	clones := make([]Expr, len(es))
+	for i := range es {
+		clones[i] = Clone(es[i])
+	}
+	return clones
+}
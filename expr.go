@@ -1,6 +1,10 @@
 package crux
 
-import "math/big"
+import (
+	"math/big"
+
+	"github.com/faiface/crux/runtime"
+)
 
 type Expr interface {
 	String() string
@@ -30,12 +34,43 @@ type (
 		Rands []Expr
 	}
 
+	Let struct {
+		Bound  []string
+		Values []Expr
+		Body   Expr
+	}
+
+	LetRec struct {
+		Bound  []string
+		Values []Expr
+		Body   Expr
+	}
+
 	Strict struct {
 		Expr Expr
 	}
 
+	// Switch branches on the constructor index of a struct, the chosen case gets applied to
+	// its fields. Default is optional and chosen without any fields when there's no case
+	// for the index.
 	Switch struct {
-		Expr  Expr
-		Cases []Expr
+		Expr    Expr
+		Cases   []Expr
+		Default Expr
+	}
+
+	// Annotated attaches a source position to an expression, it doesn't change its meaning.
+	Annotated struct {
+		Pos  runtime.Pos
+		Expr Expr
+	}
+
+	// Match branches on a Char or an Int value. Keys are *Char or *Int literals,
+	// Default is optional and chosen when no key matches.
+	Match struct {
+		Expr    Expr
+		Keys    []Expr
+		Cases   []Expr
+		Default Expr
 	}
 )
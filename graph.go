@@ -0,0 +1,350 @@
+package crux
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/faiface/crux/runtime"
+)
+
+// Graph maps each global to the globals its definition refers to. Globals are identified by
+// Vars with non-negative indices.
+type Graph map[Var][]Var
+
+// Dependencies builds the dependency graph of the globals. References to globals that aren't
+// defined are left out, the references of each global are sorted and without duplicates.
+func Dependencies(globals map[string][]Expr) Graph {
+	graph := make(Graph)
+	for name, exprs := range globals {
+		for index, e := range exprs {
+			refs := make(map[Var]bool)
+			Walk(e, func(e Expr) bool {
+				if v, ok := e.(*Var); ok && v.Index >= 0 && v.Index < int32(len(globals[v.Name])) {
+					refs[*v] = true
+				}
+				return true
+			})
+			graph[Var{Name: name, Index: int32(index)}] = sortedVars(refs)
+		}
+	}
+	return graph
+}
+
+// Components returns the strongly connected components of the graph. Every component comes
+// after the components it refers to and its globals are sorted.
+func (g Graph) Components() [][]Var {
+	var (
+		index      = make(map[Var]int)
+		low        = make(map[Var]int)
+		onStack    = make(map[Var]bool)
+		stack      []Var
+		components [][]Var
+	)
+
+	var visit func(v Var)
+	visit = func(v Var) {
+		index[v] = len(index)
+		low[v] = index[v]
+		stack = append(stack, v)
+		onStack[v] = true
+
+		for _, ref := range g[v] {
+			if _, ok := index[ref]; !ok {
+				visit(ref)
+				if low[ref] < low[v] {
+					low[v] = low[ref]
+				}
+			} else if onStack[ref] && index[ref] < low[v] {
+				low[v] = index[ref]
+			}
+		}
+
+		if low[v] == index[v] {
+			var component []Var
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				component = append(component, top)
+				if top == v {
+					break
+				}
+			}
+			sort.Slice(component, func(i, j int) bool {
+				return lessVar(component[i], component[j])
+			})
+			components = append(components, component)
+		}
+	}
+
+	nodes := make(map[Var]bool, len(g))
+	for v := range g {
+		nodes[v] = true
+	}
+	for _, v := range sortedVars(nodes) {
+		if _, ok := index[v]; !ok {
+			visit(v)
+		}
+	}
+	return components
+}
+
+// Cyclic tells whether the component of the graph contains a cycle, which is when it has
+// more than one global or its only global refers to itself.
+func (g Graph) Cyclic(component []Var) bool {
+	if len(component) > 1 {
+		return true
+	}
+	for _, ref := range g[component[0]] {
+		if ref == component[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// CAFCycles finds the globals that aren't functions and need their own values to get
+// computed, their reduction never ends. Each cycle is a path of globals that starts and ends
+// with the same global, each one needing the value of the next one.
+func CAFCycles(globals map[string][]Expr) [][]Var {
+	isCAF := func(v Var) bool {
+		switch Unannotate(globals[v.Name][v.Index]).(type) {
+		case *Char, *Int, *Float, *Operator, *Make, *Field, *Abst:
+			return false
+		default:
+			return true
+		}
+	}
+
+	d := &demander{globals: globals, summaries: make(map[Var]map[Var]bool)}
+	needs := make(Graph)
+	for name, exprs := range globals {
+		for index, e := range exprs {
+			v := Var{Name: name, Index: int32(index)}
+			if !isCAF(v) {
+				continue
+			}
+			refs := make(map[Var]bool)
+			for ref := range d.demands(e) {
+				if ref.Index >= 0 && ref.Index < int32(len(globals[ref.Name])) && isCAF(ref) {
+					refs[ref] = true
+				}
+			}
+			needs[v] = sortedVars(refs)
+		}
+	}
+
+	var cycles [][]Var
+	for _, component := range needs.Components() {
+		if !needs.Cyclic(component) {
+			continue
+		}
+		// shortest path from the first global back to itself within the component
+		inComponent := make(map[Var]bool)
+		for _, v := range component {
+			inComponent[v] = true
+		}
+		start := component[0]
+		prev := make(map[Var]Var)
+		queue := []Var{start}
+		for len(queue) > 0 {
+			v := queue[0]
+			queue = queue[1:]
+			found := false
+			for _, ref := range needs[v] {
+				if ref == start {
+					prev[start] = v
+					found = true
+					break
+				}
+				if _, seen := prev[ref]; !seen && inComponent[ref] {
+					prev[ref] = v
+					queue = append(queue, ref)
+				}
+			}
+			if found {
+				break
+			}
+		}
+		cycle := []Var{start}
+		for v := prev[start]; v != start; v = prev[v] {
+			cycle = append(cycle, v)
+		}
+		cycle = append(cycle, start)
+		for i, j := 0, len(cycle)-1; i < j; i, j = i+1, j-1 {
+			cycle[i], cycle[j] = cycle[j], cycle[i]
+		}
+		cycles = append(cycles, cycle)
+	}
+	return cycles
+}
+
+// demander finds out which globals are always needed when expressions get reduced. Local
+// variables are tracked too, as Vars with negative indices, so that calls of functions can
+// be followed into their bodies.
+type demander struct {
+	globals   map[string][]Expr
+	summaries map[Var]map[Var]bool
+}
+
+func (d *demander) demands(e Expr) map[Var]bool {
+	result := make(map[Var]bool)
+	union := func(other map[Var]bool) {
+		for v := range other {
+			result[v] = true
+		}
+	}
+
+	switch e := e.(type) {
+	case *Var:
+		result[*e] = true
+	case *Strict:
+		union(d.demands(e.Expr))
+	case *Annotated:
+		union(d.demands(e.Expr))
+	case *Appl:
+		rator, rands := Spine(e)
+		for _, rand := range rands {
+			if strict, ok := rand.(*Strict); ok {
+				union(d.demands(strict.Expr))
+			}
+		}
+		switch rator := Unannotate(rator).(type) {
+		case *Operator:
+			if runtime.IsBuiltin(rator.Code) && runtime.OperatorArity(rator.Code) == len(rands) {
+				for i, rand := range rands {
+					if rator.Code != runtime.OpDump || i == 0 {
+						union(d.demands(rand))
+					}
+				}
+			}
+		case *Field:
+			if len(rands) > 0 {
+				union(d.demands(rands[0]))
+			}
+		case *Abst:
+			union(d.call(rator, d.demands(rator.Body), rands))
+		case *Var:
+			result[*rator] = true
+			if abst, ok := d.function(rator); ok {
+				union(d.call(abst, d.summary(*rator, abst), rands))
+			}
+		default:
+			union(d.demands(rator))
+		}
+	case *Let:
+		body := d.demands(e.Body)
+		for v := range body {
+			if v.Index >= 0 || !Contains(e.Bound, v.Name) {
+				result[v] = true
+			}
+		}
+		for i, value := range e.Values {
+			_, strict := value.(*Strict)
+			if strict || (i < len(e.Bound) && body[Var{Name: e.Bound[i], Index: -1}]) {
+				union(d.demands(value))
+			}
+		}
+	case *LetRec:
+		for v := range d.demands(e.Body) {
+			if v.Index >= 0 || !Contains(e.Bound, v.Name) {
+				result[v] = true
+			}
+		}
+	case *Switch:
+		union(d.demands(e.Expr))
+		union(d.demandsAll(e.Cases, e.Default))
+	case *Match:
+		union(d.demands(e.Expr))
+		union(d.demandsAll(e.Cases, e.Default))
+	}
+	return result
+}
+
+// call returns what a call of a function with the given body demands needs, the parameters
+// of the function are replaced by the demands of the arguments.
+func (d *demander) call(abst *Abst, body map[Var]bool, rands []Expr) map[Var]bool {
+	if len(rands) < len(abst.Bound) {
+		return nil
+	}
+	result := make(map[Var]bool)
+	for v := range body {
+		if v.Index >= 0 {
+			result[v] = true
+		}
+	}
+	for i, param := range abst.Bound {
+		if body[Var{Name: param, Index: -1}] {
+			for v := range d.demands(rands[i]) {
+				result[v] = true
+			}
+		}
+	}
+	return result
+}
+
+func (d *demander) function(v *Var) (*Abst, bool) {
+	if v.Index < 0 || v.Index >= int32(len(d.globals[v.Name])) {
+		return nil, false
+	}
+	abst, ok := Unannotate(d.globals[v.Name][v.Index]).(*Abst)
+	return abst, ok
+}
+
+// summary returns the demands of the body of a global function. Recursive calls are assumed
+// to need nothing.
+func (d *demander) summary(v Var, abst *Abst) map[Var]bool {
+	if summary, ok := d.summaries[v]; ok {
+		return summary
+	}
+	d.summaries[v] = nil
+	summary := d.demands(abst.Body)
+	d.summaries[v] = summary
+	return summary
+}
+
+// demandsAll returns what all of the cases need.
+func (d *demander) demandsAll(cases []Expr, deflt Expr) map[Var]bool {
+	if deflt != nil {
+		cases = append(cases[:len(cases):len(cases)], deflt)
+	}
+	if len(cases) == 0 {
+		return nil
+	}
+	result := d.demands(cases[0])
+	for _, cas := range cases[1:] {
+		other := d.demands(cas)
+		for v := range result {
+			if !other[v] {
+				delete(result, v)
+			}
+		}
+	}
+	return result
+}
+
+func formatPath(path []Var) string {
+	parts := make([]string, len(path))
+	for i := range path {
+		parts[i] = path[i].String()
+	}
+	return strings.Join(parts, " -> ")
+}
+
+func sortedVars(set map[Var]bool) []Var {
+	vars := make([]Var, 0, len(set))
+	for v := range set {
+		vars = append(vars, v)
+	}
+	sort.Slice(vars, func(i, j int) bool {
+		return lessVar(vars[i], vars[j])
+	})
+	return vars
+}
+
+func lessVar(a, b Var) bool {
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.Index < b.Index
+}
@@ -0,0 +1,481 @@
+package crux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"github.com/faiface/crux/runtime"
+)
+
+// Image is a compiled program, as returned by Compile.
+type Image struct {
+	GlobalIndices map[string][]int32
+	GlobalValues  []runtime.Value
+	CodeIndices   map[string][]int32
+	Codes         []runtime.Code
+}
+
+const (
+	imageMagic   = "CRUX"
+	imageVersion = 1
+)
+
+const (
+	valueNone byte = iota
+	valueChar
+	valueInt
+	valueFloat
+)
+
+type imageWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (w *imageWriter) bytes(b []byte) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	w.err = err
+}
+
+func (w *imageWriter) uint(x uint64) {
+	n := binary.PutUvarint(w.buf[:], x)
+	w.bytes(w.buf[:n])
+}
+
+func (w *imageWriter) int(x int64) {
+	n := binary.PutVarint(w.buf[:], x)
+	w.bytes(w.buf[:n])
+}
+
+func (w *imageWriter) string(s string) {
+	w.uint(uint64(len(s)))
+	w.bytes([]byte(s))
+}
+
+// WriteTo writes the image in a versioned binary format that ReadImage loads. Operators are
+// stored by their names, so images stay valid when operator codes change.
+func (img *Image) WriteTo(w io.Writer) (n int64, err error) {
+	iw := &imageWriter{w: bufio.NewWriter(w)}
+
+	offsets := make(map[*runtime.Code]int, len(img.Codes))
+	for i := range img.Codes {
+		offsets[&img.Codes[i]] = i
+	}
+
+	var operators []int32
+	operatorIndices := make(map[int32]int)
+	for i := range img.Codes {
+		code := &img.Codes[i]
+		if code.Kind != runtime.CodeOperator {
+			continue
+		}
+		if runtime.OperatorArity(code.X) < 0 {
+			return 0, fmt.Errorf("code %d: wrong operator code %d", i, code.X)
+		}
+		if _, ok := operatorIndices[code.X]; !ok {
+			operatorIndices[code.X] = len(operators)
+			operators = append(operators, code.X)
+		}
+	}
+
+	iw.bytes([]byte(imageMagic))
+	iw.uint(imageVersion)
+
+	iw.uint(uint64(len(operators)))
+	for _, op := range operators {
+		iw.string(runtime.OperatorString[op])
+	}
+
+	iw.uint(uint64(len(img.Codes)))
+	for i := range img.Codes {
+		code := &img.Codes[i]
+		iw.uint(uint64(code.Kind))
+		if code.Kind == runtime.CodeOperator {
+			iw.int(int64(operatorIndices[code.X]))
+		} else {
+			iw.int(int64(code.X))
+		}
+
+		iw.uint(uint64(len(code.Table)))
+		if len(code.Table) > 0 {
+			offset, ok := offsets[&code.Table[0]]
+			if !ok || offset+len(code.Table) > len(img.Codes) {
+				return 0, fmt.Errorf("code %d: table outside of codes", i)
+			}
+			iw.uint(uint64(offset))
+		}
+
+		switch value := code.Value.(type) {
+		case nil:
+			iw.bytes([]byte{valueNone})
+		case *runtime.Char:
+			iw.bytes([]byte{valueChar})
+			iw.int(int64(value.Value))
+		case *runtime.Int:
+			iw.bytes([]byte{valueInt})
+			iw.int(int64(value.Value.Sign()))
+			abs := value.Value.Bytes()
+			iw.uint(uint64(len(abs)))
+			iw.bytes(abs)
+		case *runtime.Float:
+			iw.bytes([]byte{valueFloat})
+			var bits [8]byte
+			binary.LittleEndian.PutUint64(bits[:], math.Float64bits(value.Value))
+			iw.bytes(bits[:])
+		default:
+			return 0, fmt.Errorf("code %d: can't store value %v", i, code.Value)
+		}
+	}
+
+	names := make([]string, 0, len(img.CodeIndices))
+	for name := range img.CodeIndices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	iw.uint(uint64(len(img.GlobalValues)))
+	iw.uint(uint64(len(names)))
+	for _, name := range names {
+		globals, codes := img.GlobalIndices[name], img.CodeIndices[name]
+		if len(globals) != len(codes) {
+			return 0, fmt.Errorf("%s: %d global indices for %d code indices", name, len(globals), len(codes))
+		}
+		iw.string(name)
+		iw.uint(uint64(len(codes)))
+		for i := range codes {
+			iw.uint(uint64(globals[i]))
+			iw.uint(uint64(codes[i]))
+		}
+	}
+
+	var sources []int
+	for i := range img.Codes {
+		if img.Codes[i].Source != nil {
+			sources = append(sources, i)
+		}
+	}
+	iw.uint(uint64(len(sources)))
+	for _, i := range sources {
+		src := img.Codes[i].Source
+		iw.uint(uint64(i))
+		iw.string(src.Global)
+		iw.string(src.Pos.File)
+		iw.uint(uint64(src.Pos.Line))
+		iw.uint(uint64(src.Pos.Col))
+	}
+
+	if iw.err == nil {
+		iw.err = iw.w.Flush()
+	}
+	return iw.n, iw.err
+}
+
+type imageReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *imageReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (r *imageReader) uint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		r.fail("corrupted image: %v", err)
+	}
+	return x
+}
+
+func (r *imageReader) int() int64 {
+	if r.err != nil {
+		return 0
+	}
+	x, err := binary.ReadVarint(r.r)
+	if err != nil {
+		r.fail("corrupted image: %v", err)
+	}
+	return x
+}
+
+// count reads a number of following items, each taking at least one byte
+func (r *imageReader) count() int {
+	n := r.uint()
+	if n > uint64(r.r.Len()) {
+		r.fail("corrupted image: count %d exceeds the remaining data", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (r *imageReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > r.r.Len() {
+		r.fail("corrupted image: unexpected end")
+		return nil
+	}
+	b := make([]byte, n)
+	r.r.Read(b)
+	return b
+}
+
+func (r *imageReader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *imageReader) string() string {
+	return string(r.bytes(r.count()))
+}
+
+// ReadImage loads an image written by WriteTo. It checks that the image is consistent and
+// records the sources of the codes, like Compile does.
+func ReadImage(rd io.Reader) (*Image, error) {
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(imageMagic)) {
+		return nil, errors.New("not a crux image")
+	}
+	r := &imageReader{r: bytes.NewReader(data[len(imageMagic):])}
+	if version := r.uint(); r.err == nil && version != imageVersion {
+		return nil, fmt.Errorf("unsupported image version %d", version)
+	}
+
+	operators := make([]int32, r.count())
+	for i := range operators {
+		name := r.string()
+		code, ok := runtime.OperatorCode(name)
+		if !ok {
+			r.fail("no operator named %s", name)
+		}
+		operators[i] = code
+	}
+
+	img := &Image{
+		GlobalIndices: make(map[string][]int32),
+		CodeIndices:   make(map[string][]int32),
+		Codes:         make([]runtime.Code, r.count()),
+	}
+	for i := range img.Codes {
+		code := &img.Codes[i]
+		code.Kind = runtime.CodeKind(r.uint())
+		if !code.Kind.Valid() {
+			r.fail("code %d: invalid kind %d", i, code.Kind)
+		}
+		x := r.int()
+		if x < math.MinInt32 || x > math.MaxInt32 {
+			r.fail("code %d: operand %d out of range", i, x)
+		}
+		code.X = int32(x)
+		if code.Kind == runtime.CodeOperator {
+			if code.X < 0 || int(code.X) >= len(operators) {
+				r.fail("code %d: invalid operator %d", i, code.X)
+			} else {
+				code.X = operators[code.X]
+			}
+		}
+
+		if size := r.uint(); size > 0 {
+			offset := r.uint()
+			if offset+size > uint64(len(img.Codes)) {
+				r.fail("code %d: table outside of codes", i)
+			} else {
+				code.Table = img.Codes[offset : offset+size]
+			}
+		}
+
+		switch r.byte() {
+		case valueNone:
+		case valueChar:
+			code.Value = &runtime.Char{Value: rune(r.int())}
+		case valueInt:
+			var value runtime.Int
+			sign := r.int()
+			value.Value.SetBytes(r.bytes(r.count()))
+			if sign < 0 {
+				value.Value.Neg(&value.Value)
+			}
+			code.Value = &value
+		case valueFloat:
+			bits := r.bytes(8)
+			if bits != nil {
+				code.Value = &runtime.Float{Value: math.Float64frombits(binary.LittleEndian.Uint64(bits))}
+			}
+		default:
+			r.fail("code %d: invalid value", i)
+		}
+
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+
+	img.GlobalValues = make([]runtime.Value, r.count())
+	for names := r.count(); names > 0 && r.err == nil; names-- {
+		name := r.string()
+		if _, ok := img.CodeIndices[name]; ok {
+			r.fail("%s defined twice", name)
+		}
+		for n := r.count(); n > 0 && r.err == nil; n-- {
+			global, code := r.uint(), r.uint()
+			if global >= uint64(len(img.GlobalValues)) || code >= uint64(len(img.Codes)) {
+				r.fail("%s: index out of range", name)
+				break
+			}
+			if img.GlobalValues[global] != nil {
+				r.fail("%s: global %d defined twice", name, global)
+				break
+			}
+			img.GlobalIndices[name] = append(img.GlobalIndices[name], int32(global))
+			img.CodeIndices[name] = append(img.CodeIndices[name], int32(code))
+			img.GlobalValues[global] = globalValue(&img.Codes[code])
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := img.check(); err != nil {
+		return nil, err
+	}
+
+	sources := make(map[int]runtime.Source)
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		i := r.uint()
+		var src runtime.Source
+		src.Global = r.string()
+		src.Pos.File = r.string()
+		src.Pos.Line = int(r.uint())
+		src.Pos.Col = int(r.uint())
+		if i >= uint64(len(img.Codes)) {
+			r.fail("source of code %d out of range", i)
+		}
+		sources[int(i)] = src
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.r.Len() > 0 {
+		return nil, errors.New("corrupted image: trailing data")
+	}
+	for i := range sources {
+		src := sources[i]
+		img.Codes[i].Source = &src
+	}
+
+	return img, nil
+}
+
+// globalValue returns the value of a global with the given top-level code.
+func globalValue(code *runtime.Code) runtime.Value {
+	if code.Kind == runtime.CodeValue {
+		return code.Value
+	}
+	return &runtime.Thunk{Code: code}
+}
+
+func (img *Image) check() error {
+	for i := range img.GlobalValues {
+		if img.GlobalValues[i] == nil {
+			return fmt.Errorf("global %d not defined", i)
+		}
+	}
+	for i := range img.Codes {
+		if err := checkCode(img, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkCode(img *Image, i int) error {
+	code := &img.Codes[i]
+	fail := func(format string, args ...interface{}) error {
+		return fmt.Errorf("code %d (%v): %s", i, code.Kind, fmt.Sprintf(format, args...))
+	}
+
+	if (code.Value != nil) != (code.Kind == runtime.CodeValue) {
+		return fail("value doesn't match the kind")
+	}
+
+	tableSize := -1
+	switch code.Kind {
+	case runtime.CodeValue, runtime.CodeOperator, runtime.CodeMake, runtime.CodeField,
+		runtime.CodeVar, runtime.CodeGlobal:
+		tableSize = 0
+	case runtime.CodeAbst, runtime.CodeFastAbst, runtime.CodeStrict:
+		tableSize = 1
+	case runtime.CodeLet, runtime.CodeLetRec:
+		tableSize = 1 + int(code.X)
+	case runtime.CodeSelect:
+		tableSize = 1
+		if len(code.Table) == 1 && code.Table[0].Kind != runtime.CodeVar {
+			return fail("selecting from %v", code.Table[0].Kind)
+		}
+	case runtime.CodeClosure:
+		tableSize = 1 + int(code.X)
+		for j := 1; j < len(code.Table); j++ {
+			if code.Table[j].Kind != runtime.CodeVar {
+				return fail("captured %d is not a variable", j-1)
+			}
+		}
+	case runtime.CodeAppl:
+		if len(code.Table) < 1 {
+			return fail("empty table")
+		}
+	case runtime.CodeSwitch:
+		if len(code.Table) != 1+int(code.X) && len(code.Table) != 2+int(code.X) {
+			return fail("table doesn't match %d cases", code.X)
+		}
+	case runtime.CodeMatch:
+		if len(code.Table) != 1+2*int(code.X) && len(code.Table) != 2+2*int(code.X) {
+			return fail("table doesn't match %d keys", code.X)
+		}
+		for j := 1; j <= int(code.X); j++ {
+			if code.Table[j].Kind != runtime.CodeValue {
+				return fail("key %d is not a value", j-1)
+			}
+		}
+	}
+	if tableSize >= 0 && len(code.Table) != tableSize {
+		return fail("table of size %d, expected %d", len(code.Table), tableSize)
+	}
+
+	switch code.Kind {
+	case runtime.CodeMake, runtime.CodeField, runtime.CodeVar, runtime.CodeAbst, runtime.CodeFastAbst,
+		runtime.CodeLet, runtime.CodeLetRec, runtime.CodeSwitch, runtime.CodeMatch, runtime.CodeClosure,
+		runtime.CodeSelect:
+		if code.X < 0 {
+			return fail("negative operand %d", code.X)
+		}
+	case runtime.CodeGlobal:
+		if code.X < 0 || int(code.X) >= len(img.GlobalValues) {
+			return fail("global %d out of range", code.X)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package crux
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/faiface/crux/runtime"
+)
+
+// Expressions are encoded as JSON objects tagged by their kind:
+//
+//	{"kind": "appl", "rator": {"kind": "operator", "name": "+/int"}, "rands": [...]}
+//
+// Int values are encoded as decimal strings to keep them exact, non-finite Float values
+// as "NaN", "+Inf" and "-Inf". Operators are encoded by their names.
+
+type jsonPos struct {
+	File string `json:"file,omitempty"`
+	Line int    `json:"line"`
+	Col  int    `json:"col"`
+}
+
+type jsonOut struct {
+	Kind    string      `json:"kind"`
+	Value   interface{} `json:"value,omitempty"`
+	Name    string      `json:"name,omitempty"`
+	Index   *int32      `json:"index,omitempty"`
+	Pos     *jsonPos    `json:"pos,omitempty"`
+	Bound   []string    `json:"bound,omitempty"`
+	Values  []Expr      `json:"values,omitempty"`
+	Rator   Expr        `json:"rator,omitempty"`
+	Rands   []Expr      `json:"rands,omitempty"`
+	Expr    Expr        `json:"expr,omitempty"`
+	Keys    []Expr      `json:"keys,omitempty"`
+	Cases   []Expr      `json:"cases,omitempty"`
+	Default Expr        `json:"default,omitempty"`
+	Body    Expr        `json:"body,omitempty"`
+}
+
+type jsonIn struct {
+	Kind    string            `json:"kind"`
+	Value   json.RawMessage   `json:"value"`
+	Name    string            `json:"name"`
+	Index   *int32            `json:"index"`
+	Pos     *jsonPos          `json:"pos"`
+	Bound   []string          `json:"bound"`
+	Values  []json.RawMessage `json:"values"`
+	Rator   json.RawMessage   `json:"rator"`
+	Rands   []json.RawMessage `json:"rands"`
+	Expr    json.RawMessage   `json:"expr"`
+	Keys    []json.RawMessage `json:"keys"`
+	Cases   []json.RawMessage `json:"cases"`
+	Default json.RawMessage   `json:"default"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+func marshalExpr(e Expr) ([]byte, error) {
+	var out jsonOut
+	switch e := e.(type) {
+	case *Char:
+		out.Kind, out.Value = "char", e.Value
+	case *Int:
+		out.Kind, out.Value = "int", e.Value.String()
+	case *Float:
+		out.Kind = "float"
+		switch {
+		case math.IsNaN(e.Value):
+			out.Value = "NaN"
+		case math.IsInf(e.Value, +1):
+			out.Value = "+Inf"
+		case math.IsInf(e.Value, -1):
+			out.Value = "-Inf"
+		default:
+			out.Value = e.Value
+		}
+	case *Operator:
+		if runtime.OperatorArity(e.Code) < 0 {
+			return nil, fmt.Errorf("wrong operator code %d", e.Code)
+		}
+		out.Kind, out.Name = "operator", e.String()
+	case *Make:
+		out.Kind, out.Index = "make", &e.Index
+	case *Field:
+		out.Kind, out.Index = "field", &e.Index
+	case *Var:
+		out.Kind, out.Name, out.Index = "var", e.Name, &e.Index
+	case *Abst:
+		out.Kind, out.Bound, out.Body = "abst", e.Bound, e.Body
+	case *Appl:
+		out.Kind, out.Rator, out.Rands = "appl", e.Rator, e.Rands
+	case *Let:
+		out.Kind, out.Bound, out.Values, out.Body = "let", e.Bound, e.Values, e.Body
+	case *LetRec:
+		out.Kind, out.Bound, out.Values, out.Body = "letrec", e.Bound, e.Values, e.Body
+	case *Strict:
+		out.Kind, out.Expr = "strict", e.Expr
+	case *Annotated:
+		out.Kind, out.Expr = "annotated", e.Expr
+		out.Pos = &jsonPos{File: e.Pos.File, Line: e.Pos.Line, Col: e.Pos.Col}
+	case *Switch:
+		out.Kind, out.Expr, out.Cases, out.Default = "switch", e.Expr, e.Cases, e.Default
+	case *Match:
+		out.Kind, out.Expr, out.Keys, out.Cases, out.Default = "match", e.Expr, e.Keys, e.Cases, e.Default
+	default:
+		return nil, fmt.Errorf("unknown expression %T", e)
+	}
+	return json.Marshal(&out)
+}
+
+// UnmarshalExpr decodes an expression of any kind from JSON.
+func UnmarshalExpr(data []byte) (Expr, error) {
+	var in jsonIn
+	if err := json.Unmarshal(data, &in); err != nil {
+		return nil, err
+	}
+
+	var err error
+	expr := func(raw json.RawMessage) Expr {
+		if err != nil {
+			return nil
+		}
+		if len(raw) == 0 || string(raw) == "null" {
+			err = fmt.Errorf("%s: missing expression", in.Kind)
+			return nil
+		}
+		var e Expr
+		e, err = UnmarshalExpr(raw)
+		return e
+	}
+	optional := func(raw json.RawMessage) Expr {
+		if len(raw) == 0 || string(raw) == "null" {
+			return nil
+		}
+		return expr(raw)
+	}
+	exprs := func(raws []json.RawMessage) []Expr {
+		if raws == nil {
+			return nil
+		}
+		es := make([]Expr, len(raws))
+		for i := range raws {
+			es[i] = expr(raws[i])
+		}
+		return es
+	}
+	index := func() int32 {
+		if in.Index == nil {
+			if err == nil {
+				err = fmt.Errorf("%s: missing index", in.Kind)
+			}
+			return 0
+		}
+		return *in.Index
+	}
+
+	var e Expr
+	switch in.Kind {
+	case "char":
+		var c Char
+		err = json.Unmarshal(in.Value, &c.Value)
+		e = &c
+	case "int":
+		var (
+			i Int
+			s string
+		)
+		if err = json.Unmarshal(in.Value, &s); err == nil {
+			if _, ok := i.Value.SetString(s, 10); !ok {
+				err = fmt.Errorf("int: invalid value %s", s)
+			}
+		}
+		e = &i
+	case "float":
+		var (
+			f Float
+			s string
+		)
+		if json.Unmarshal(in.Value, &s) == nil {
+			f.Value, err = strconv.ParseFloat(s, 64)
+		} else {
+			err = json.Unmarshal(in.Value, &f.Value)
+		}
+		e = &f
+	case "operator":
+		code, ok := runtime.OperatorCode(in.Name)
+		if !ok {
+			err = fmt.Errorf("operator: no operator named %s", in.Name)
+		}
+		e = &Operator{Code: code}
+	case "make":
+		e = &Make{Index: index()}
+	case "field":
+		e = &Field{Index: index()}
+	case "var":
+		e = &Var{Name: in.Name, Index: index()}
+	case "abst":
+		e = &Abst{Bound: in.Bound, Body: expr(in.Body)}
+	case "appl":
+		e = &Appl{Rator: expr(in.Rator), Rands: exprs(in.Rands)}
+	case "let":
+		e = &Let{Bound: in.Bound, Values: exprs(in.Values), Body: expr(in.Body)}
+	case "letrec":
+		e = &LetRec{Bound: in.Bound, Values: exprs(in.Values), Body: expr(in.Body)}
+	case "strict":
+		e = &Strict{Expr: expr(in.Expr)}
+	case "annotated":
+		var pos runtime.Pos
+		if in.Pos != nil {
+			pos = runtime.Pos{File: in.Pos.File, Line: in.Pos.Line, Col: in.Pos.Col}
+		}
+		e = &Annotated{Pos: pos, Expr: expr(in.Expr)}
+	case "switch":
+		e = &Switch{Expr: expr(in.Expr), Cases: exprs(in.Cases), Default: optional(in.Default)}
+	case "match":
+		e = &Match{Expr: expr(in.Expr), Keys: exprs(in.Keys), Cases: exprs(in.Cases), Default: optional(in.Default)}
+	default:
+		return nil, fmt.Errorf("unknown expression kind %q", in.Kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func kindOf(e Expr) string {
+	switch e.(type) {
+	case *Char:
+		return "char"
+	case *Int:
+		return "int"
+	case *Float:
+		return "float"
+	case *Operator:
+		return "operator"
+	case *Make:
+		return "make"
+	case *Field:
+		return "field"
+	case *Var:
+		return "var"
+	case *Abst:
+		return "abst"
+	case *Appl:
+		return "appl"
+	case *Let:
+		return "let"
+	case *LetRec:
+		return "letrec"
+	case *Strict:
+		return "strict"
+	case *Annotated:
+		return "annotated"
+	case *Switch:
+		return "switch"
+	case *Match:
+		return "match"
+	default:
+		panic(fmt.Sprintf("unknown expression %T", e))
+	}
+}
+
+func unmarshalInto(data []byte, dst Expr) error {
+	e, err := UnmarshalExpr(data)
+	if err != nil {
+		return err
+	}
+	if kindOf(e) != kindOf(dst) {
+		return fmt.Errorf("expected %s, got %s", kindOf(dst), kindOf(e))
+	}
+	switch dst := dst.(type) {
+	case *Char:
+		*dst = *e.(*Char)
+	case *Int:
+		dst.Value.Set(&e.(*Int).Value)
+	case *Float:
+		*dst = *e.(*Float)
+	case *Operator:
+		*dst = *e.(*Operator)
+	case *Make:
+		*dst = *e.(*Make)
+	case *Field:
+		*dst = *e.(*Field)
+	case *Var:
+		*dst = *e.(*Var)
+	case *Abst:
+		*dst = *e.(*Abst)
+	case *Appl:
+		*dst = *e.(*Appl)
+	case *Let:
+		*dst = *e.(*Let)
+	case *LetRec:
+		*dst = *e.(*LetRec)
+	case *Strict:
+		*dst = *e.(*Strict)
+	case *Annotated:
+		*dst = *e.(*Annotated)
+	case *Switch:
+		*dst = *e.(*Switch)
+	case *Match:
+		*dst = *e.(*Match)
+	}
+	return nil
+}
+
+func (c *Char) MarshalJSON() ([]byte, error)      { return marshalExpr(c) }
+func (i *Int) MarshalJSON() ([]byte, error)       { return marshalExpr(i) }
+func (f *Float) MarshalJSON() ([]byte, error)     { return marshalExpr(f) }
+func (o *Operator) MarshalJSON() ([]byte, error)  { return marshalExpr(o) }
+func (m *Make) MarshalJSON() ([]byte, error)      { return marshalExpr(m) }
+func (f *Field) MarshalJSON() ([]byte, error)     { return marshalExpr(f) }
+func (v *Var) MarshalJSON() ([]byte, error)       { return marshalExpr(v) }
+func (a *Abst) MarshalJSON() ([]byte, error)      { return marshalExpr(a) }
+func (a *Appl) MarshalJSON() ([]byte, error)      { return marshalExpr(a) }
+func (l *Let) MarshalJSON() ([]byte, error)       { return marshalExpr(l) }
+func (l *LetRec) MarshalJSON() ([]byte, error)    { return marshalExpr(l) }
+func (s *Strict) MarshalJSON() ([]byte, error)    { return marshalExpr(s) }
+func (a *Annotated) MarshalJSON() ([]byte, error) { return marshalExpr(a) }
+func (s *Switch) MarshalJSON() ([]byte, error)    { return marshalExpr(s) }
+func (m *Match) MarshalJSON() ([]byte, error)     { return marshalExpr(m) }
+
+func (c *Char) UnmarshalJSON(data []byte) error      { return unmarshalInto(data, c) }
+func (i *Int) UnmarshalJSON(data []byte) error       { return unmarshalInto(data, i) }
+func (f *Float) UnmarshalJSON(data []byte) error     { return unmarshalInto(data, f) }
+func (o *Operator) UnmarshalJSON(data []byte) error  { return unmarshalInto(data, o) }
+func (m *Make) UnmarshalJSON(data []byte) error      { return unmarshalInto(data, m) }
+func (f *Field) UnmarshalJSON(data []byte) error     { return unmarshalInto(data, f) }
+func (v *Var) UnmarshalJSON(data []byte) error       { return unmarshalInto(data, v) }
+func (a *Abst) UnmarshalJSON(data []byte) error      { return unmarshalInto(data, a) }
+func (a *Appl) UnmarshalJSON(data []byte) error      { return unmarshalInto(data, a) }
+func (l *Let) UnmarshalJSON(data []byte) error       { return unmarshalInto(data, l) }
+func (l *LetRec) UnmarshalJSON(data []byte) error    { return unmarshalInto(data, l) }
+func (s *Strict) UnmarshalJSON(data []byte) error    { return unmarshalInto(data, s) }
+func (a *Annotated) UnmarshalJSON(data []byte) error { return unmarshalInto(data, a) }
+func (s *Switch) UnmarshalJSON(data []byte) error    { return unmarshalInto(data, s) }
+func (m *Match) UnmarshalJSON(data []byte) error     { return unmarshalInto(data, m) }
+
+// Program is a set of globals, like the ones Compile takes. Unlike a plain map, it can be
+// decoded from JSON.
+type Program map[string][]Expr
+
+func (p *Program) UnmarshalJSON(data []byte) error {
+	var raw map[string][]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	program := make(Program, len(raw))
+	for name, raws := range raw {
+		exprs := make([]Expr, len(raws))
+		for i := range raws {
+			e, err := UnmarshalExpr(raws[i])
+			if err != nil {
+				return fmt.Errorf("%s/%d: %v", name, i, err)
+			}
+			exprs[i] = e
+		}
+		program[name] = exprs
+	}
+	*p = program
+	return nil
+}
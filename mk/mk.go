@@ -1,21 +1,13 @@
 package mk
 
 import (
+	"fmt"
 	"math/big"
 
 	"github.com/faiface/crux"
 	"github.com/faiface/crux/runtime"
 )
 
-var operators map[string]int32
-
-func init() {
-	operators = make(map[string]int32)
-	for code, str := range runtime.OperatorString {
-		operators[str] = int32(code)
-	}
-}
-
 func Char(c rune) *crux.Char {
 	return &crux.Char{Value: c}
 }
@@ -40,6 +32,14 @@ func Op(code int32) *crux.Operator {
 	return &crux.Operator{Code: code}
 }
 
+func OpNamed(name string) *crux.Operator {
+	code, ok := runtime.OperatorCode(name)
+	if !ok {
+		panic(fmt.Sprintf("no operator named %s", name))
+	}
+	return &crux.Operator{Code: code}
+}
+
 func Make(index int32) *crux.Make {
 	return &crux.Make{Index: index}
 }
@@ -66,6 +66,70 @@ func Strict(expr crux.Expr) *crux.Strict {
 	return &crux.Strict{Expr: expr}
 }
 
+func Annotated(file string, line, col int, expr crux.Expr) *crux.Annotated {
+	return &crux.Annotated{Pos: runtime.Pos{File: file, Line: line, Col: col}, Expr: expr}
+}
+
 func Switch(expr crux.Expr, cases ...crux.Expr) *crux.Switch {
 	return &crux.Switch{Expr: expr, Cases: cases}
 }
+
+func SwitchDefault(expr crux.Expr, deflt crux.Expr, cases ...crux.Expr) *crux.Switch {
+	return &crux.Switch{Expr: expr, Cases: cases, Default: deflt}
+}
+
+func Match(expr crux.Expr, keys []crux.Expr, cases []crux.Expr, deflt crux.Expr) *crux.Match {
+	return &crux.Match{Expr: expr, Keys: keys, Cases: cases, Default: deflt}
+}
+
+// If switches on a boolean, constructor 0 is true, constructor 1 is false.
+func If(cond, then, els crux.Expr) *crux.Switch {
+	return Switch(cond, then, els)
+}
+
+// List makes a list using constructor 0 for the empty list and constructor 1 for cons.
+func List(elems ...crux.Expr) crux.Expr {
+	var list crux.Expr = Make(0)
+	for i := len(elems) - 1; i >= 0; i-- {
+		list = Appl(Make(1), elems[i], list)
+	}
+	return list
+}
+
+func String(s string) crux.Expr {
+	var elems []crux.Expr
+	for _, c := range s {
+		elems = append(elems, Char(c))
+	}
+	return List(elems...)
+}
+
+// Let binds the values to the names in the body. The body is an abstraction, so it can only
+// refer to the bound names and globals.
+func Let(bound []string, values ...crux.Expr) func(body crux.Expr) crux.Expr {
+	return func(body crux.Expr) crux.Expr {
+		return Appl(Abst(bound...)(body), values...)
+	}
+}
+
+// Bind and BindRec make Let and LetRec expressions. Unlike with Let, which predates them, the
+// body can refer to the enclosing locals.
+func Bind(bound []string, values ...crux.Expr) func(body crux.Expr) *crux.Let {
+	return func(body crux.Expr) *crux.Let {
+		return &crux.Let{Bound: bound, Values: values, Body: body}
+	}
+}
+
+func BindRec(bound []string, values ...crux.Expr) func(body crux.Expr) *crux.LetRec {
+	return func(body crux.Expr) *crux.LetRec {
+		return &crux.LetRec{Bound: bound, Values: values, Body: body}
+	}
+}
+
+// Chain applies the rator to the rands one by one: (((rator a) b) c).
+func Chain(rator crux.Expr, rands ...crux.Expr) crux.Expr {
+	for _, rand := range rands {
+		rator = Appl(rator, rand)
+	}
+	return rator
+}
@@ -0,0 +1,110 @@
+package opt
+
+import (
+	"github.com/faiface/crux"
+	"github.com/faiface/crux/runtime"
+)
+
+// Fold makes a pass that evaluates saturated applications of operators to Char, Int and
+// Float literals at compile time, using the runtime implementation of the operators. Error,
+// dump and registered operators are left alone, and so are the applications that fail or
+// whose result can't be expressed as an expression.
+func Fold() Pass {
+	return Each("fold", func(e crux.Expr) (crux.Expr, int) {
+		changes := 0
+		e = crux.Rewrite(e, func(e crux.Expr) crux.Expr {
+			if folded, ok := fold(e); ok {
+				changes++
+				return folded
+			}
+			return e
+		})
+		return e, changes
+	})
+}
+
+func fold(e crux.Expr) (folded crux.Expr, ok bool) {
+	appl, isAppl := e.(*crux.Appl)
+	if !isAppl {
+		return e, false
+	}
+	rator, rands := crux.Spine(appl)
+	op, isOp := crux.Unannotate(rator).(*crux.Operator)
+	if !isOp || !runtime.IsBuiltin(op.Code) || op.Code == runtime.OpError || op.Code == runtime.OpDump {
+		return e, false
+	}
+	if runtime.OperatorArity(op.Code) != len(rands) {
+		return e, false
+	}
+
+	args := make([]runtime.Value, len(rands))
+	for i, rand := range rands {
+		switch rand := literal(rand).(type) {
+		case *crux.Char:
+			args[i] = &runtime.Char{Value: rand.Value}
+		case *crux.Int:
+			arg := &runtime.Int{}
+			arg.Value.Set(&rand.Value)
+			args[i] = arg
+		case *crux.Float:
+			args[i] = &runtime.Float{Value: rand.Value}
+		default:
+			return e, false
+		}
+	}
+
+	defer func() {
+		// the operator failed, it will fail at runtime too
+		if recover() != nil {
+			folded, ok = e, false
+		}
+	}()
+	return toExpr(runtime.ApplyOperator(nil, op.Code, args...))
+}
+
+// literal strips annotations and strictness, which make no difference for literals.
+func literal(e crux.Expr) crux.Expr {
+	for {
+		switch inner := e.(type) {
+		case *crux.Annotated:
+			e = inner.Expr
+		case *crux.Strict:
+			e = inner.Expr
+		default:
+			return e
+		}
+	}
+}
+
+func toExpr(value runtime.Value) (crux.Expr, bool) {
+	switch value := value.(type) {
+	case *runtime.Char:
+		return &crux.Char{Value: value.Value}, true
+	case *runtime.Int:
+		e := &crux.Int{}
+		e.Value.Set(&value.Value)
+		return e, true
+	case *runtime.Float:
+		return &crux.Float{Value: value.Value}, true
+	case *runtime.Struct:
+		if len(value.Values) == 0 {
+			return &crux.Make{Index: value.Index}, true
+		}
+		fields := make([]crux.Expr, len(value.Values))
+		for i := range fields {
+			field, ok := toExpr(value.Values[len(value.Values)-1-i])
+			if !ok {
+				return nil, false
+			}
+			fields[i] = field
+		}
+		return &crux.Appl{Rator: &crux.Make{Index: value.Index}, Rands: fields}, true
+	case *runtime.Thunk:
+		if value.Result == nil {
+			return nil, false
+		}
+		return toExpr(value.Result)
+	default:
+		return nil, false
+	}
+}
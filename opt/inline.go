@@ -0,0 +1,140 @@
+package opt
+
+import "github.com/faiface/crux"
+
+type global struct {
+	Name  string
+	Index int32
+}
+
+// Inline makes a pass that replaces references to globals with their definitions. Functions
+// are inlined when they have at most maxSize nodes or are referenced only once, a call with
+// enough arguments becomes a Let binding the arguments. Other definitions are only inlined
+// when they are atoms, so that no shared computation gets duplicated. Recursive globals are
+// never inlined.
+func Inline(maxSize int) Pass {
+	return Pass{
+		Name: "inline",
+		Run: func(globals map[string][]crux.Expr) (map[string][]crux.Expr, int) {
+			uses := make(map[global]int)
+			for _, exprs := range globals {
+				for _, e := range exprs {
+					crux.Walk(e, func(e crux.Expr) bool {
+						if v, ok := e.(*crux.Var); ok && v.Index >= 0 {
+							uses[global{v.Name, v.Index}]++
+						}
+						return true
+					})
+				}
+			}
+			recursive := recursiveGlobals(globals)
+
+			definition := func(v *crux.Var, stack []global) (crux.Expr, bool) {
+				g := global{v.Name, v.Index}
+				if v.Index < 0 || v.Index >= int32(len(globals[v.Name])) || recursive[g] {
+					return nil, false
+				}
+				for _, outer := range stack {
+					if outer == g {
+						return nil, false
+					}
+				}
+				def := globals[v.Name][v.Index]
+				switch crux.Unannotate(def).(type) {
+				case *crux.Char, *crux.Int, *crux.Float, *crux.Operator, *crux.Make, *crux.Field, *crux.Var:
+					return def, true
+				case *crux.Abst:
+					return def, size(def) <= maxSize || uses[g] == 1
+				default:
+					return nil, false
+				}
+			}
+
+			changes := 0
+			var inline func(e crux.Expr, stack []global) crux.Expr
+			inline = func(e crux.Expr, stack []global) crux.Expr {
+				switch e := e.(type) {
+				case *crux.Var:
+					def, ok := definition(e, stack)
+					if !ok {
+						return e
+					}
+					changes++
+					return inline(def, append(stack, global{e.Name, e.Index}))
+
+				case *crux.Appl:
+					rator, rands := crux.Spine(e)
+					v, ok := rator.(*crux.Var)
+					if !ok {
+						break
+					}
+					def, ok := definition(v, stack)
+					if !ok {
+						break
+					}
+					abst, ok := crux.Unannotate(def).(*crux.Abst)
+					if !ok || len(rands) < len(abst.Bound) {
+						break
+					}
+					changes++
+					n := len(abst.Bound)
+					values := make([]crux.Expr, n)
+					for i := range values {
+						values[i] = inline(rands[i], stack)
+					}
+					let := &crux.Let{
+						Bound:  abst.Bound,
+						Values: values,
+						Body:   inline(abst.Body, append(stack, global{v.Name, v.Index})),
+					}
+					if len(rands) == n {
+						return let
+					}
+					rest := make([]crux.Expr, len(rands)-n)
+					for i := range rest {
+						rest[i] = inline(rands[n+i], stack)
+					}
+					return &crux.Appl{Rator: let, Rands: rest}
+				}
+
+				children := crux.Children(e)
+				changed := false
+				for i := range children {
+					child := inline(children[i], stack)
+					if child != children[i] {
+						children[i] = child
+						changed = true
+					}
+				}
+				if !changed {
+					return e
+				}
+				return crux.WithChildren(e, children)
+			}
+
+			result := make(map[string][]crux.Expr, len(globals))
+			for name, exprs := range globals {
+				result[name] = make([]crux.Expr, len(exprs))
+				for i, e := range exprs {
+					result[name][i] = inline(e, []global{{name, int32(i)}})
+				}
+			}
+			return result, changes
+		},
+	}
+}
+
+// recursiveGlobals finds the globals that can reach themselves through references.
+func recursiveGlobals(globals map[string][]crux.Expr) map[global]bool {
+	graph := crux.Dependencies(globals)
+	recursive := make(map[global]bool)
+	for _, component := range graph.Components() {
+		if !graph.Cyclic(component) {
+			continue
+		}
+		for _, v := range component {
+			recursive[global{v.Name, v.Index}] = true
+		}
+	}
+	return recursive
+}
@@ -0,0 +1,95 @@
+package opt
+
+import "github.com/faiface/crux"
+
+// Closure describes an abstraction lifted out by LiftLambdas. Global is the new global, it
+// takes the captured variables first and then the original parameters. Where the abstraction
+// used to be, the lifted program applies Global to the captured variables, so code generators
+// can build a closure record from Global and Captured instead.
+type Closure struct {
+	Global   *crux.Var
+	Parent   *crux.Var
+	Captured []string
+	Arity    int
+}
+
+// LiftLambdas moves every abstraction that isn't the whole definition of a global into a new
+// global, so that the only abstractions left are at the top of globals. Abstractions in the
+// input may refer to the local variables around them, which the compiler doesn't allow, the
+// lifted program is closed. The abstractions lifted out of name/i become overloads of
+// name$lambda, numbered in the order of the globals and of the abstractions within them,
+// innermost first. LiftLambdas returns the lifted program and the closures in the same order.
+func LiftLambdas(globals map[string][]crux.Expr) (map[string][]crux.Expr, []Closure) {
+	result := make(map[string][]crux.Expr, len(globals))
+	for name, exprs := range globals {
+		result[name] = append([]crux.Expr(nil), exprs...)
+	}
+
+	var closures []Closure
+	for _, name := range names(globals) {
+		for i := range globals[name] {
+			parent := &crux.Var{Name: name, Index: int32(i)}
+			lifted := name + "$lambda"
+
+			lift := func(e crux.Expr) crux.Expr {
+				abst, ok := e.(*crux.Abst)
+				if !ok {
+					return e
+				}
+				captured := crux.FreeVars(abst)
+				global := &crux.Var{Name: lifted, Index: int32(len(result[lifted]))}
+				result[lifted] = append(result[lifted], &crux.Abst{
+					Bound: append(append([]string(nil), captured...), abst.Bound...),
+					Body:  abst.Body,
+				})
+				closures = append(closures, Closure{
+					Global:   global,
+					Parent:   parent,
+					Captured: captured,
+					Arity:    len(abst.Bound),
+				})
+				if len(captured) == 0 {
+					return global
+				}
+				rands := make([]crux.Expr, len(captured))
+				for j, local := range captured {
+					rands[j] = &crux.Var{Name: local, Index: -1}
+				}
+				return &crux.Appl{Rator: global, Rands: rands}
+			}
+
+			// the abstraction defining the global stays, only its body gets lifted
+			var top func(e crux.Expr) crux.Expr
+			top = func(e crux.Expr) crux.Expr {
+				switch e := e.(type) {
+				case *crux.Annotated:
+					if inner := top(e.Expr); inner != e.Expr {
+						return &crux.Annotated{Pos: e.Pos, Expr: inner}
+					}
+					return e
+				case *crux.Abst:
+					if body := crux.Rewrite(e.Body, lift); body != e.Body {
+						return &crux.Abst{Bound: e.Bound, Body: body}
+					}
+					return e
+				default:
+					return crux.Rewrite(e, lift)
+				}
+			}
+			result[name][i] = top(globals[name][i])
+		}
+	}
+	return result, closures
+}
+
+// Lift makes a pass that lifts abstractions into globals with LiftLambdas and counts the
+// lifted abstractions as changes.
+func Lift() Pass {
+	return Pass{
+		Name: "lift",
+		Run: func(globals map[string][]crux.Expr) (map[string][]crux.Expr, int) {
+			lifted, closures := LiftLambdas(globals)
+			return lifted, len(closures)
+		},
+	}
+}
@@ -0,0 +1,148 @@
+package opt
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/faiface/crux"
+)
+
+// Pass transforms a program. Run must not modify the expressions it gets, it returns the new
+// program along with the number of changes it made.
+type Pass struct {
+	Name string
+	Run  func(globals map[string][]crux.Expr) (map[string][]crux.Expr, int)
+}
+
+// Stat describes a single run of a pass. Sizes are the numbers of expression nodes in the
+// program before and after the pass.
+type Stat struct {
+	Pass       string
+	Time       time.Duration
+	Changes    int
+	Before     int
+	After      int
+	Validation time.Duration
+}
+
+func (s Stat) String() string {
+	return fmt.Sprintf("%s: %d changes, size %d -> %d, %v", s.Pass, s.Changes, s.Before, s.After, s.Time)
+}
+
+// Pipeline runs passes one after another. With Validate set, the program is validated before
+// the first pass and after each pass. When Dump is not nil, the program is written to it after
+// each pass.
+type Pipeline struct {
+	Passes   []Pass
+	Validate bool
+	Dump     io.Writer
+}
+
+// Run runs all passes over the program and returns the optimized program with a Stat for each
+// pass. It stops at the first pass that produces an invalid program.
+func (p *Pipeline) Run(globals map[string][]crux.Expr) (map[string][]crux.Expr, []Stat, error) {
+	if p.Validate {
+		if err := crux.Validate(globals); err != nil {
+			return nil, nil, fmt.Errorf("before optimization:\n%v", err)
+		}
+	}
+
+	stats := make([]Stat, 0, len(p.Passes))
+	size := Size(globals)
+	for _, pass := range p.Passes {
+		start := time.Now()
+		result, changes := pass.Run(globals)
+		stat := Stat{
+			Pass:    pass.Name,
+			Time:    time.Since(start),
+			Changes: changes,
+			Before:  size,
+			After:   Size(result),
+		}
+		size = stat.After
+		globals = result
+
+		if p.Validate {
+			start := time.Now()
+			err := crux.Validate(globals)
+			stat.Validation = time.Since(start)
+			if err != nil {
+				return nil, append(stats, stat), fmt.Errorf("after %s:\n%v", pass.Name, err)
+			}
+		}
+		stats = append(stats, stat)
+
+		if p.Dump != nil {
+			fmt.Fprintf(p.Dump, "; after %s\n", pass.Name)
+			if err := Dump(p.Dump, globals); err != nil {
+				return nil, stats, err
+			}
+		}
+	}
+
+	return globals, stats, nil
+}
+
+// Dump writes the program to w, one global per line, sorted by name.
+func Dump(w io.Writer, globals map[string][]crux.Expr) error {
+	for _, name := range names(globals) {
+		for index, e := range globals[name] {
+			if _, err := fmt.Fprintf(w, "%s/%d = %v\n", name, index, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Size returns the number of expression nodes in the program.
+func Size(globals map[string][]crux.Expr) int {
+	total := 0
+	for _, exprs := range globals {
+		for _, e := range exprs {
+			total += size(e)
+		}
+	}
+	return total
+}
+
+func size(e crux.Expr) int {
+	n := 0
+	crux.Walk(e, func(crux.Expr) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// Each makes a pass that transforms every global separately with fn. The function returns
+// the new expression and the number of changes it made.
+func Each(name string, fn func(e crux.Expr) (crux.Expr, int)) Pass {
+	return Pass{
+		Name: name,
+		Run: func(globals map[string][]crux.Expr) (map[string][]crux.Expr, int) {
+			result := make(map[string][]crux.Expr, len(globals))
+			total := 0
+			for name, exprs := range globals {
+				result[name] = make([]crux.Expr, len(exprs))
+				for i, e := range exprs {
+					var changes int
+					result[name][i], changes = fn(e)
+					total += changes
+				}
+			}
+			return result, total
+		},
+	}
+}
+
+func names(globals map[string][]crux.Expr) []string {
+	names := make([]string, 0, len(globals))
+	for name := range globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
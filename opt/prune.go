@@ -0,0 +1,75 @@
+package opt
+
+import "github.com/faiface/crux"
+
+// Prune removes the globals that can't be reached from the entry points, which are global
+// variables like main/0. The remaining overloads of each name get renumbered and references to
+// them are updated. Prune returns the pruned program along with the removed globals, sorted
+// and with their original indices. Entry points that aren't defined are ignored.
+func Prune(globals map[string][]crux.Expr, entries ...*crux.Var) (map[string][]crux.Expr, []*crux.Var) {
+	reachable := make(map[global]bool)
+	var visit func(g global)
+	visit = func(g global) {
+		if reachable[g] || g.Index < 0 || g.Index >= int32(len(globals[g.Name])) {
+			return
+		}
+		reachable[g] = true
+		crux.Walk(globals[g.Name][g.Index], func(e crux.Expr) bool {
+			if v, ok := e.(*crux.Var); ok && v.Index >= 0 {
+				visit(global{v.Name, v.Index})
+			}
+			return true
+		})
+	}
+	for _, entry := range entries {
+		visit(global{entry.Name, entry.Index})
+	}
+
+	var removed []*crux.Var
+	indices := make(map[global]int32)
+	for _, name := range names(globals) {
+		kept := int32(0)
+		for i := range globals[name] {
+			g := global{name, int32(i)}
+			if !reachable[g] {
+				removed = append(removed, &crux.Var{Name: name, Index: g.Index})
+				continue
+			}
+			indices[g] = kept
+			kept++
+		}
+	}
+
+	pruned := make(map[string][]crux.Expr)
+	for name, exprs := range globals {
+		for i, e := range exprs {
+			if !reachable[global{name, int32(i)}] {
+				continue
+			}
+			pruned[name] = append(pruned[name], crux.Rewrite(e, func(e crux.Expr) crux.Expr {
+				v, ok := e.(*crux.Var)
+				if !ok || v.Index < 0 {
+					return e
+				}
+				// references to globals that aren't defined are left for Validate to report
+				if index, ok := indices[global{v.Name, v.Index}]; ok && index != v.Index {
+					return &crux.Var{Name: v.Name, Index: index}
+				}
+				return e
+			}))
+		}
+	}
+	return pruned, removed
+}
+
+// DeadGlobals makes a pass that prunes the program with Prune and counts the removed globals
+// as changes.
+func DeadGlobals(entries ...*crux.Var) Pass {
+	return Pass{
+		Name: "dead-globals",
+		Run: func(globals map[string][]crux.Expr) (map[string][]crux.Expr, int) {
+			pruned, removed := Prune(globals, entries...)
+			return pruned, len(removed)
+		},
+	}
+}
@@ -0,0 +1,237 @@
+package opt
+
+import "github.com/faiface/crux"
+
+const maxSimplifyRounds = 16
+
+// Simplify makes a pass that performs these reductions until there are none left:
+//
+//   - saturated applications of abstractions become Lets, atomic arguments and abstractions
+//     used once are substituted directly, unused ones are dropped
+//   - the same goes for the bindings of Lets
+//   - a Switch over a known constructor becomes its case applied to the fields
+//   - a Match over a literal becomes its case
+//   - a Field of a known constructor becomes the field
+//
+// Strict fields of a constructor are never dropped, the reductions that would drop them
+// aren't made.
+func Simplify() Pass {
+	return Each("simplify", func(e crux.Expr) (crux.Expr, int) {
+		changes := 0
+		for round := 0; round < maxSimplifyRounds; round++ {
+			before := changes
+			e = crux.Rewrite(e, func(e crux.Expr) crux.Expr {
+				if simplified, ok := simplify(e); ok {
+					changes++
+					return simplified
+				}
+				return e
+			})
+			if changes == before {
+				break
+			}
+		}
+		return e, changes
+	})
+}
+
+func simplify(e crux.Expr) (crux.Expr, bool) {
+	switch e := e.(type) {
+	case *crux.Appl:
+		rator, rands := crux.Spine(e)
+		switch rator := crux.Unannotate(rator).(type) {
+		case *crux.Abst:
+			n := len(rator.Bound)
+			if len(rands) < n {
+				return e, false
+			}
+			result, _ := bind(rator.Bound, rands[:n], rator.Body)
+			return apply(result, rands[n:]), true
+		case *crux.Field:
+			if len(rands) == 0 {
+				return e, false
+			}
+			fields, ok := knownFields(rands[0])
+			if !ok || int(rator.Index) >= len(fields) || anyStrict(fields, int(rator.Index)) {
+				return e, false
+			}
+			field := fields[rator.Index]
+			if strict, ok := crux.Unannotate(field).(*crux.Strict); ok {
+				field = strict.Expr
+			}
+			return apply(field, rands[1:]), true
+		}
+
+	case *crux.Let:
+		if result, ok := bind(e.Bound, e.Values, e.Body); ok {
+			return result, true
+		}
+
+	case *crux.Switch:
+		rator, fields := crux.Spine(crux.Unannotate(e.Expr))
+		mk, ok := crux.Unannotate(rator).(*crux.Make)
+		if !ok {
+			return e, false
+		}
+		if int(mk.Index) < len(e.Cases) {
+			return apply(e.Cases[mk.Index], fields), true
+		}
+		if e.Default != nil && !anyStrict(fields, -1) {
+			return e.Default, true
+		}
+
+	case *crux.Match:
+		key := crux.Unannotate(e.Expr)
+		switch key.(type) {
+		case *crux.Char, *crux.Int:
+		default:
+			return e, false
+		}
+		for i := range e.Keys {
+			if crux.Equal(key, e.Keys[i]) {
+				return e.Cases[i], true
+			}
+		}
+		if e.Default != nil {
+			return e.Default, true
+		}
+	}
+	return e, false
+}
+
+// bind binds the values to the names in the body, substituting the atomic values and the
+// abstractions used once, and leaving the rest in a Let. It tells whether any binding was
+// removed, otherwise the result is just a Let of everything.
+func bind(names []string, values []crux.Expr, body crux.Expr) (crux.Expr, bool) {
+	var (
+		subst     = make(map[string]crux.Expr)
+		letBound  []string
+		letValues []crux.Expr
+	)
+	for i, name := range names {
+		uses := occurrences(body, name)
+		_, strict := values[i].(*crux.Strict)
+		switch {
+		case strict:
+			// evaluated eagerly, so it must stay even if unused
+			letBound = append(letBound, name)
+			letValues = append(letValues, values[i])
+		case uses == 0:
+		case atomic(values[i]):
+			subst[name] = values[i]
+		case uses == 1 && isAbst(values[i]):
+			subst[name] = values[i]
+		default:
+			letBound = append(letBound, name)
+			letValues = append(letValues, values[i])
+		}
+	}
+	if len(letBound) == len(names) {
+		return &crux.Let{Bound: names, Values: values, Body: body}, false
+	}
+
+	// the substituted values come from outside of the Let, so they can't refer to its names
+	captured := make(map[string]bool)
+	avoid := make(map[string]bool)
+	for _, value := range subst {
+		for _, name := range crux.FreeVars(value) {
+			captured[name] = true
+			avoid[name] = true
+		}
+	}
+	for _, name := range crux.FreeVars(body) {
+		avoid[name] = true
+	}
+	for _, name := range names {
+		avoid[name] = true
+	}
+	for i, name := range letBound {
+		if captured[name] {
+			fresh := crux.Fresh(name, avoid)
+			avoid[fresh] = true
+			subst[name] = &crux.Var{Name: fresh, Index: -1}
+			letBound[i] = fresh
+		}
+	}
+
+	body = crux.Subst(body, subst)
+	if len(letBound) == 0 {
+		return body, true
+	}
+	return &crux.Let{Bound: letBound, Values: letValues, Body: body}, true
+}
+
+func apply(rator crux.Expr, rands []crux.Expr) crux.Expr {
+	if len(rands) == 0 {
+		return rator
+	}
+	return &crux.Appl{Rator: rator, Rands: rands}
+}
+
+// knownFields returns the fields of e if it's an application of a constructor.
+func knownFields(e crux.Expr) ([]crux.Expr, bool) {
+	rator, fields := crux.Spine(crux.Unannotate(e))
+	if _, ok := crux.Unannotate(rator).(*crux.Make); !ok {
+		return nil, false
+	}
+	return fields, true
+}
+
+// anyStrict tells whether any of the fields other than the one at except is Strict, those
+// can't be dropped, they're evaluated even when unused.
+func anyStrict(fields []crux.Expr, except int) bool {
+	for i, field := range fields {
+		if _, ok := crux.Unannotate(field).(*crux.Strict); ok && i != except {
+			return true
+		}
+	}
+	return false
+}
+
+func atomic(e crux.Expr) bool {
+	switch crux.Unannotate(e).(type) {
+	case *crux.Char, *crux.Int, *crux.Float, *crux.Operator, *crux.Make, *crux.Field, *crux.Var:
+		return true
+	default:
+		return false
+	}
+}
+
+func isAbst(e crux.Expr) bool {
+	_, ok := crux.Unannotate(e).(*crux.Abst)
+	return ok
+}
+
+// occurrences counts the free occurrences of the local variable name in e.
+func occurrences(e crux.Expr, name string) int {
+	switch e := e.(type) {
+	case *crux.Var:
+		if e.Index < 0 && e.Name == name {
+			return 1
+		}
+		return 0
+	case *crux.Abst:
+		if crux.Contains(e.Bound, name) {
+			return 0
+		}
+		return occurrences(e.Body, name)
+	case *crux.Let:
+		n := 0
+		for _, value := range e.Values {
+			n += occurrences(value, name)
+		}
+		if !crux.Contains(e.Bound, name) {
+			n += occurrences(e.Body, name)
+		}
+		return n
+	case *crux.LetRec:
+		if crux.Contains(e.Bound, name) {
+			return 0
+		}
+	}
+	n := 0
+	for _, child := range crux.Children(e) {
+		n += occurrences(child, name)
+	}
+	return n
+}
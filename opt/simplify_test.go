@@ -0,0 +1,53 @@
+package opt_test
+
+import (
+	"testing"
+
+	"github.com/faiface/crux"
+	"github.com/faiface/crux/mk"
+	"github.com/faiface/crux/opt"
+	"github.com/faiface/crux/runtime"
+)
+
+func TestSimplifyKeepsStrictFields(t *testing.T) {
+	fail := mk.Strict(mk.Appl(mk.OpNamed("//int"), mk.Int(1), mk.Int(0)))
+	globals := map[string][]crux.Expr{
+		"field":  {mk.Appl(mk.Field(0), mk.Appl(mk.Make(0), mk.Int(1), fail))},
+		"switch": {mk.SwitchDefault(mk.Appl(mk.Make(1), fail), mk.Int(1), mk.Int(0))},
+	}
+	simplified, _, err := (&opt.Pipeline{Passes: []opt.Pass{opt.Simplify()}, Validate: true}).Run(globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalIndices, globalValues, _, _ := crux.Compile(simplified)
+	for _, name := range []string{"field", "switch"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: the strict field wasn't evaluated", name)
+				}
+			}()
+			runtime.Reduce(globalValues, globalValues[globalIndices[name][0]])
+		}()
+	}
+}
+
+func TestSimplifySelectsStrictField(t *testing.T) {
+	globals := map[string][]crux.Expr{
+		"f": {mk.Abst("a")(mk.Appl(mk.Field(0), mk.Appl(mk.Make(0),
+			mk.Strict(mk.Appl(mk.OpNamed("+/int"), mk.Var("a", -1), mk.Int(1))))))},
+		"main": {mk.Appl(mk.Var("f", 0), mk.Int(41))},
+	}
+	simplified, _, err := (&opt.Pipeline{Passes: []opt.Pass{opt.Simplify()}, Validate: true}).Run(globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := crux.Unannotate(simplified["f"][0].(*crux.Abst).Body).(*crux.Strict); ok {
+		t.Errorf("selected field is still strict: %v", simplified["f"][0])
+	}
+	globalIndices, globalValues, _, _ := crux.Compile(simplified)
+	result := runtime.Reduce(globalValues, globalValues[globalIndices["main"][0]])
+	if i, ok := result.(*runtime.Int); !ok || i.Value.Int64() != 42 {
+		t.Errorf("main reduced to %v, want 42", result)
+	}
+}
@@ -0,0 +1,343 @@
+package opt
+
+import (
+	"github.com/faiface/crux"
+	"github.com/faiface/crux/runtime"
+)
+
+// StrictParams finds out which parameters of the globals defined as abstractions are always
+// reduced to values when the global is applied to exactly all of its arguments and reduced to
+// a value. Parameters are strict when they're reduced by operators, scrutinized by Switch or
+// Match, accessed by Field, returned as the result or passed as strict arguments to other
+// globals. Parameters that are only applied as functions aren't strict, they may be partial
+// applications.
+//
+// The result contains an entry for every global, nil for the ones that aren't abstractions.
+func StrictParams(globals map[string][]crux.Expr) map[string][][]bool {
+	return analyze(globals).saturated
+}
+
+func analyze(globals map[string][]crux.Expr) *strictness {
+	a := &strictness{params: allStrict(globals)}
+	a.weaken(globals, a.params, false)
+	// saturated calls rely on the params found so far for the calls that aren't
+	a.saturated = allStrict(globals)
+	a.nullary = true
+	a.weaken(globals, a.saturated, true)
+	a.nullary = false
+	return a
+}
+
+func allStrict(globals map[string][]crux.Expr) map[string][][]bool {
+	params := make(map[string][][]bool, len(globals))
+	for name, exprs := range globals {
+		params[name] = make([][]bool, len(exprs))
+		for i, e := range exprs {
+			if abst, ok := crux.Unannotate(e).(*crux.Abst); ok {
+				params[name][i] = make([]bool, len(abst.Bound))
+				for j := range params[name][i] {
+					params[name][i][j] = true
+				}
+			}
+		}
+	}
+	return params
+}
+
+// weaken clears the params that aren't forced by the bodies of the globals, reduced as values
+// or not, until nothing changes.
+func (a *strictness) weaken(globals map[string][]crux.Expr, params map[string][][]bool, value bool) {
+	for changed := true; changed; {
+		changed = false
+		for name, exprs := range globals {
+			for i, e := range exprs {
+				abst, ok := crux.Unannotate(e).(*crux.Abst)
+				if !ok {
+					continue
+				}
+				forced := a.forces(abst.Body, value)
+				for j, param := range abst.Bound {
+					if params[name][i][j] && !forced[param] {
+						params[name][i][j] = false
+						changed = true
+					}
+				}
+			}
+		}
+	}
+}
+
+// Strictness makes a pass that wraps arguments in Strict wherever they're going to be reduced
+// anyway, so that no thunks get allocated for them. That's the strict parameters of globals
+// found by StrictParams, the arguments of operators and the bindings of Lets forced by their
+// bodies. Atomic arguments are left alone, they don't need thunks.
+//
+// A call with all of its arguments may still be reduced as a function when it returns one, so
+// the parameters that are only strict for saturated calls get Strict arguments only when those
+// can't reduce to functions, like applications of operators and constructors.
+func Strictness() Pass {
+	return Pass{
+		Name: "strictness",
+		Run: func(globals map[string][]crux.Expr) (map[string][]crux.Expr, int) {
+			a := analyze(globals)
+			changes := 0
+			wrap := func(e crux.Expr) crux.Expr {
+				if _, ok := e.(*crux.Strict); ok || atomic(e) || isAbst(e) {
+					return e
+				}
+				changes++
+				return &crux.Strict{Expr: e}
+			}
+
+			result := make(map[string][]crux.Expr, len(globals))
+			for name, exprs := range globals {
+				result[name] = make([]crux.Expr, len(exprs))
+				for i, e := range exprs {
+					result[name][i] = crux.Rewrite(e, func(e crux.Expr) crux.Expr {
+						switch e := e.(type) {
+						case *crux.Appl:
+							rator, rands := crux.Spine(e)
+							strict := a.strictArgs(rator, len(rands), false)
+							saturated := a.strictArgs(rator, len(rands), true)
+							if saturated == nil {
+								return e
+							}
+							newRands := make([]crux.Expr, len(rands))
+							changed := false
+							for j := range rands {
+								newRands[j] = rands[j]
+								if j < len(strict) && strict[j] || j < len(saturated) && saturated[j] && notFunction(rands[j]) {
+									newRands[j] = wrap(rands[j])
+								}
+								changed = changed || newRands[j] != rands[j]
+							}
+							if !changed {
+								return e
+							}
+							return &crux.Appl{Rator: rator, Rands: newRands}
+
+						case *crux.Let:
+							forced := a.forces(e.Body, false)
+							var values []crux.Expr
+							for j, name := range e.Bound {
+								if !forced[name] {
+									continue
+								}
+								if value := wrap(e.Values[j]); value != e.Values[j] {
+									if values == nil {
+										values = append([]crux.Expr(nil), e.Values...)
+									}
+									values[j] = value
+								}
+							}
+							if values == nil {
+								return e
+							}
+							return &crux.Let{Bound: e.Bound, Values: values, Body: e.Body}
+						}
+						return e
+					})
+				}
+			}
+			return result, changes
+		},
+	}
+}
+
+// strictness holds the strict params of globals applied to at least all of their arguments and
+// the ones of saturated calls reduced to values. While analyzing saturated calls, nullary is
+// set and Switch cases that aren't abstractions count as reduced like the whole Switch, which
+// is only true for constructors without fields, but the saturated params are only used with
+// arguments that can't be functions.
+type strictness struct {
+	params    map[string][][]bool
+	saturated map[string][][]bool
+	nullary   bool
+}
+
+// strictArgs tells which arguments of an application of rator to n arguments are reduced
+// by the application, or nil if it's not known. With value set, the application is reduced
+// to a value.
+func (a *strictness) strictArgs(rator crux.Expr, n int, value bool) []bool {
+	switch rator := crux.Unannotate(rator).(type) {
+	case *crux.Operator:
+		if !runtime.IsBuiltin(rator.Code) || runtime.OperatorArity(rator.Code) != n {
+			return nil
+		}
+		strict := make([]bool, n)
+		for i := range strict {
+			strict[i] = true
+		}
+		if rator.Code == runtime.OpDump {
+			strict[1] = false
+		}
+		return strict
+	case *crux.Field:
+		if n < 1 {
+			return nil
+		}
+		return []bool{true}
+	case *crux.Var:
+		if rator.Index < 0 || rator.Index >= int32(len(a.params[rator.Name])) {
+			return nil
+		}
+		strict := a.params[rator.Name][rator.Index]
+		if saturated := a.saturated[rator.Name]; value && saturated != nil && n == len(strict) {
+			return saturated[rator.Index]
+		}
+		if strict == nil || n < len(strict) {
+			return nil
+		}
+		return strict
+	}
+	return nil
+}
+
+// forces returns the local variables that are always reduced to values when e is reduced.
+// With value set, e itself is reduced to a value, otherwise it may be a function. Only values
+// count, so operands of operators, scrutinees of Switch and Match and structs accessed by
+// Field, because putting a function in Strict would reduce it without its arguments.
+func (a *strictness) forces(e crux.Expr, value bool) map[string]bool {
+	switch e := e.(type) {
+	case *crux.Var:
+		if e.Index < 0 && value {
+			return map[string]bool{e.Name: true}
+		}
+		return nil
+	case *crux.Strict:
+		return a.forces(e.Expr, true)
+	case *crux.Annotated:
+		return a.forces(e.Expr, value)
+	case *crux.Appl:
+		rator, rands := crux.Spine(e)
+		return a.spine(rator, rands, value)
+
+	case *crux.Let:
+		forced := a.forces(e.Body, value)
+		result := make(map[string]bool)
+		for name := range forced {
+			if !crux.Contains(e.Bound, name) {
+				result[name] = true
+			}
+		}
+		for i, name := range e.Bound {
+			_, strict := e.Values[i].(*crux.Strict)
+			if forced[name] || strict {
+				union(result, a.forces(e.Values[i], true))
+			}
+		}
+		return result
+
+	case *crux.LetRec:
+		result := make(map[string]bool)
+		for name := range a.forces(e.Body, value) {
+			if !crux.Contains(e.Bound, name) {
+				result[name] = true
+			}
+		}
+		return result
+
+	case *crux.Switch:
+		// cases get applied to the fields, so unless they're known to be nullary, they're only
+		// known to be reduced to functions
+		var cases []map[string]bool
+		for _, cas := range e.Cases {
+			cases = append(cases, a.forces(cas, value && a.nullary))
+		}
+		if e.Default != nil {
+			cases = append(cases, a.forces(e.Default, value))
+		}
+		result := make(map[string]bool)
+		union(result, a.forces(e.Expr, true))
+		union(result, intersection(cases))
+		return result
+
+	case *crux.Match:
+		var cases []map[string]bool
+		for _, cas := range e.Cases {
+			cases = append(cases, a.forces(cas, value))
+		}
+		if e.Default != nil {
+			cases = append(cases, a.forces(e.Default, value))
+		}
+		result := make(map[string]bool)
+		union(result, a.forces(e.Expr, true))
+		union(result, intersection(cases))
+		return result
+	}
+	return nil
+}
+
+func (a *strictness) spine(rator crux.Expr, rands []crux.Expr, value bool) map[string]bool {
+	result := make(map[string]bool)
+	for _, rand := range rands {
+		if strict, ok := rand.(*crux.Strict); ok {
+			union(result, a.forces(strict.Expr, true))
+		}
+	}
+
+	if abst, ok := crux.Unannotate(rator).(*crux.Abst); ok {
+		if len(rands) < len(abst.Bound) {
+			return result
+		}
+		forced := a.forces(abst.Body, value && len(rands) == len(abst.Bound))
+		for i, param := range abst.Bound {
+			if forced[param] {
+				union(result, a.forces(rands[i], true))
+			}
+		}
+		return result
+	}
+
+	for i, strict := range a.strictArgs(rator, len(rands), value) {
+		if strict {
+			union(result, a.forces(rands[i], true))
+		}
+	}
+	// the rator is reduced to a function
+	union(result, a.forces(rator, false))
+	return result
+}
+
+// notFunction tells whether e surely reduces to a value.
+func notFunction(e crux.Expr) bool {
+	switch e := crux.Unannotate(e).(type) {
+	case *crux.Char, *crux.Int, *crux.Float, *crux.Strict:
+		return true
+	case *crux.Let:
+		return notFunction(e.Body)
+	case *crux.Appl:
+		rator, rands := crux.Spine(e)
+		switch rator := crux.Unannotate(rator).(type) {
+		case *crux.Make:
+			return true
+		case *crux.Operator:
+			return runtime.IsBuiltin(rator.Code) && rator.Code != runtime.OpDump &&
+				runtime.OperatorArity(rator.Code) == len(rands)
+		}
+	}
+	return false
+}
+
+func union(dst, src map[string]bool) {
+	for name := range src {
+		dst[name] = true
+	}
+}
+
+func intersection(sets []map[string]bool) map[string]bool {
+	if len(sets) == 0 {
+		return nil
+	}
+	result := make(map[string]bool)
+	for name := range sets[0] {
+		result[name] = true
+		for _, set := range sets[1:] {
+			if !set[name] {
+				delete(result, name)
+				break
+			}
+		}
+	}
+	return result
+}
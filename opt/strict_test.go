@@ -0,0 +1,72 @@
+package opt_test
+
+import (
+	"testing"
+
+	"github.com/faiface/crux"
+	"github.com/faiface/crux/mk"
+	"github.com/faiface/crux/opt"
+	"github.com/faiface/crux/runtime"
+)
+
+func TestStrictnessPartialApplication(t *testing.T) {
+	globals := map[string][]crux.Expr{
+		"add":  {mk.Abst("x", "y")(mk.Appl(mk.OpNamed("+/int"), mk.Var("x", -1), mk.Var("y", -1)))},
+		"g":    {mk.Abst("p")(mk.Appl(mk.Var("p", -1), mk.Int(1)))},
+		"main": {mk.Appl(mk.Var("g", 0), mk.Appl(mk.Var("add", 0), mk.Int(41)))},
+	}
+
+	if params := opt.StrictParams(globals); params["g"][0][0] {
+		t.Error("parameter applied as a function is strict")
+	}
+
+	optimized, _, err := (&opt.Pipeline{Passes: []opt.Pass{opt.Strictness()}, Validate: true}).Run(globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalIndices, globalValues, _, _ := crux.Compile(optimized)
+	result := runtime.Reduce(globalValues, globalValues[globalIndices["main"][0]])
+	if i, ok := result.(*runtime.Int); !ok || i.Value.Int64() != 42 {
+		t.Errorf("main reduced to %v, want 42", result)
+	}
+}
+
+func TestStrictnessAccumulator(t *testing.T) {
+	n, acc := mk.Var("n", -1), mk.Var("acc", -1)
+	globals := map[string][]crux.Expr{
+		"loop": {mk.Abst("n", "acc")(mk.If(
+			mk.Appl(mk.OpNamed("==/int"), n, mk.Int(0)),
+			acc,
+			mk.Appl(mk.Var("loop", 0), mk.Appl(mk.OpNamed("-/int"), n, mk.Int(1)), mk.Appl(mk.OpNamed("+/int"), acc, n)),
+		))},
+		"pick": {mk.Abst("n", "f")(mk.If(mk.Appl(mk.OpNamed("==/int"), n, mk.Int(0)), mk.Var("f", -1), mk.Var("f", -1)))},
+		"add":  {mk.Abst("x", "y")(mk.Appl(mk.OpNamed("+/int"), mk.Var("x", -1), mk.Var("y", -1)))},
+		"g":    {mk.Abst("p")(mk.Appl(mk.Var("p", -1), mk.Int(1)))},
+		"main": {mk.Appl(mk.Make(0),
+			mk.Appl(mk.Var("loop", 0), mk.Int(100000), mk.Int(0)),
+			mk.Appl(mk.Var("g", 0), mk.Appl(mk.Var("pick", 0), mk.Int(0), mk.Appl(mk.Var("add", 0), mk.Int(41)))),
+		)},
+	}
+
+	if params := opt.StrictParams(globals); !params["loop"][0][0] || !params["loop"][0][1] {
+		t.Errorf("loop has strict params %v, want [true true]", params["loop"][0])
+	}
+
+	optimized, _, err := (&opt.Pipeline{Passes: []opt.Pass{opt.Strictness()}, Validate: true}).Run(globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rands := crux.Spine(optimized["loop"][0].(*crux.Abst).Body.(*crux.Switch).Cases[1])
+	if _, ok := rands[1].(*crux.Strict); !ok {
+		t.Error("accumulator isn't strict in the recursive call")
+	}
+
+	globalIndices, globalValues, _, _ := crux.Compile(optimized)
+	result := runtime.Reduce(globalValues, globalValues[globalIndices["main"][0]]).(*runtime.Struct)
+	want := []int64{42, 5000050000}
+	for i, value := range result.Values {
+		if n, ok := runtime.Reduce(globalValues, value).(*runtime.Int); !ok || n.Value.Int64() != want[i] {
+			t.Errorf("field %d reduced to %v, want %d", len(result.Values)-1-i, value, want[i])
+		}
+	}
+}
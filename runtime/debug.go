@@ -0,0 +1,57 @@
+package runtime
+
+import "fmt"
+
+// Pos is a position in the source file a front end compiled from. Line and Col start at 1,
+// zero Line means no position.
+type Pos struct {
+	File      string
+	Line, Col int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// Source tells where a code was compiled from, runtime errors use it to tell where they
+// happened.
+type Source struct {
+	Global string
+	Pos    Pos
+}
+
+func (s Source) String() string {
+	if s.Pos.Line == 0 {
+		return s.Global
+	}
+	return fmt.Sprintf("%v in %s", s.Pos, s.Global)
+}
+
+// located is a panic that already tells where it happened.
+type located string
+
+func (l located) Error() string {
+	return string(l)
+}
+
+func fail(code *Code, format string, args ...interface{}) {
+	panic(located(fmt.Sprintf(format, args...) + " at " + describe(code)))
+}
+
+// locate adds the location of the code to a panic going through it, unless it already has
+// one.
+func locate(code *Code) {
+	if r := recover(); r != nil {
+		if _, ok := r.(located); ok {
+			panic(r)
+		}
+		fail(code, "%v", r)
+	}
+}
+
+func describe(code *Code) string {
+	if code.Source != nil {
+		return code.Source.String()
+	}
+	return "unknown location"
+}
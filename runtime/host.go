@@ -0,0 +1,94 @@
+package runtime
+
+import "fmt"
+
+// HostFunc implements an operator in Go. Args are in application order, strict arguments
+// are already reduced, lazy ones may be reduced by the function itself with Reduce.
+type HostFunc func(globals []Value, args []Value) Value
+
+type hostOperator struct {
+	strict []bool
+	fn     HostFunc
+}
+
+var (
+	hostBase      int32
+	hostOperators []hostOperator
+	operatorCodes map[string]int32
+)
+
+func init() {
+	hostBase = int32(len(OperatorString))
+	operatorCodes = make(map[string]int32)
+	for code, name := range OperatorString {
+		operatorCodes[name] = int32(code)
+	}
+}
+
+// Register adds a host-defined operator and returns its code. The operator takes one argument
+// per element of strict, the elements say which arguments get reduced before fn is called.
+//
+// Register is not safe for concurrent use and should be called during initialization,
+// before any code using the operator is compiled.
+func Register(name string, strict []bool, fn HostFunc) int32 {
+	if _, ok := operatorCodes[name]; ok {
+		panic(fmt.Sprintf("operator %s already exists", name))
+	}
+	code := int32(len(OperatorString))
+	OperatorString = append(OperatorString, name)
+	operatorArity = append(operatorArity, len(strict))
+	hostOperators = append(hostOperators, hostOperator{
+		strict: append([]bool(nil), strict...),
+		fn:     fn,
+	})
+	operatorCodes[name] = code
+	return code
+}
+
+// OperatorCode returns the code of the builtin or registered operator with the given name.
+func OperatorCode(name string) (code int32, ok bool) {
+	code, ok = operatorCodes[name]
+	return code, ok
+}
+
+// OperatorArity returns the number of arguments the operator takes, or -1 if there's no such operator.
+func OperatorArity(code int32) int {
+	if code < 0 || code >= int32(len(operatorArity)) {
+		return -1
+	}
+	return operatorArity[code]
+}
+
+// IsBuiltin tells whether the operator is builtin, as opposed to registered with Register.
+func IsBuiltin(code int32) bool {
+	return code >= 0 && code < hostBase
+}
+
+// ApplyOperator applies the operator to the arguments given in application order, with the
+// same semantics as during reduction.
+func ApplyOperator(globals []Value, code int32, args ...Value) Value {
+	if arity := OperatorArity(code); arity != len(args) {
+		panic(fmt.Sprintf("operator %d takes %d arguments, got %d", code, arity, len(args)))
+	}
+	if code >= hostBase {
+		return operatorHost(globals, code, append([]Value(nil), args...))
+	}
+	switch len(args) {
+	case 1:
+		return operator1(globals, code, args[0])
+	case 2:
+		return operator2(globals, code, args[0], args[1])
+	default:
+		panic("invalid arity")
+	}
+}
+
+func operatorHost(globals []Value, code int32, args []Value) Value {
+	op := &hostOperators[code-hostBase]
+	for i := range args {
+		if op.strict[i] {
+			args[i] = Reduce(globals, args[i])
+		}
+	}
+	return Reduce(globals, op.fn(globals, args))
+}
@@ -94,14 +94,65 @@ const (
 	OpFloatHypot
 	OpFloatGamma
 
+	OpIntRat
+	OpFloatRat
+	OpRatInt
+	OpRatFloat
+	OpRatString
+	OpRatNum
+	OpRatDenom
+	OpRatNeg
+	OpRatAbs
+	OpRatInv
+	OpRatAdd
+	OpRatSub
+	OpRatMul
+	OpRatDiv
+	OpRatEq
+	OpRatNeq
+	OpRatLess
+	OpRatLessEq
+	OpRatMore
+	OpRatMoreEq
+	OpRatIsZero
+
+	OpIntBigFloat
+	OpFloatBigFloat
+	OpRatBigFloat
+	OpBigFloatInt
+	OpBigFloatFloat
+	OpBigFloatRat
+	OpBigFloatString
+	OpBigFloatPrec
+	OpBigFloatNeg
+	OpBigFloatAbs
+	OpBigFloatAdd
+	OpBigFloatSub
+	OpBigFloatMul
+	OpBigFloatDiv
+	OpBigFloatSqrt
+	OpBigFloatEq
+	OpBigFloatNeq
+	OpBigFloatLess
+	OpBigFloatLessEq
+	OpBigFloatMore
+	OpBigFloatMoreEq
+
 	OpStringInt
 	OpStringFloat
+	OpStringRat
+	OpStringBigFloat
+
+	OpRandNew
+	OpRandInt
+	OpRandFloat
+	OpRandSplit
 
 	OpError
 	OpDump
 )
 
-var operatorArity = [...]int{
+var operatorArity = []int{
 	OpCharInt:          1,
 	OpCharInc:          1,
 	OpCharDec:          1,
@@ -186,14 +237,65 @@ var operatorArity = [...]int{
 	OpFloatHypot:      2,
 	OpFloatGamma:      1,
 
-	OpStringInt:   1,
-	OpStringFloat: 1,
+	OpIntRat:    1,
+	OpFloatRat:  1,
+	OpRatInt:    1,
+	OpRatFloat:  1,
+	OpRatString: 1,
+	OpRatNum:    1,
+	OpRatDenom:  1,
+	OpRatNeg:    1,
+	OpRatAbs:    1,
+	OpRatInv:    1,
+	OpRatAdd:    2,
+	OpRatSub:    2,
+	OpRatMul:    2,
+	OpRatDiv:    2,
+	OpRatEq:     2,
+	OpRatNeq:    2,
+	OpRatLess:   2,
+	OpRatLessEq: 2,
+	OpRatMore:   2,
+	OpRatMoreEq: 2,
+	OpRatIsZero: 1,
+
+	OpIntBigFloat:    1,
+	OpFloatBigFloat:  1,
+	OpRatBigFloat:    1,
+	OpBigFloatInt:    1,
+	OpBigFloatFloat:  1,
+	OpBigFloatRat:    1,
+	OpBigFloatString: 1,
+	OpBigFloatPrec:   2,
+	OpBigFloatNeg:    1,
+	OpBigFloatAbs:    1,
+	OpBigFloatAdd:    2,
+	OpBigFloatSub:    2,
+	OpBigFloatMul:    2,
+	OpBigFloatDiv:    2,
+	OpBigFloatSqrt:   1,
+	OpBigFloatEq:     2,
+	OpBigFloatNeq:    2,
+	OpBigFloatLess:   2,
+	OpBigFloatLessEq: 2,
+	OpBigFloatMore:   2,
+	OpBigFloatMoreEq: 2,
+
+	OpStringInt:      1,
+	OpStringFloat:    1,
+	OpStringRat:      1,
+	OpStringBigFloat: 1,
+
+	OpRandNew:   1,
+	OpRandInt:   2,
+	OpRandFloat: 1,
+	OpRandSplit: 1,
 
 	OpError: 1,
 	OpDump:  2,
 }
 
-var OperatorString = [...]string{
+var OperatorString = []string{
 	OpCharInt:          "char->int",
 	OpCharInc:          "inc/char",
 	OpCharDec:          "dec/char",
@@ -278,15 +380,88 @@ var OperatorString = [...]string{
 	OpFloatHypot:      "hypot",
 	OpFloatGamma:      "gamma",
 
-	OpStringInt:   "string->int",
-	OpStringFloat: "string->float",
+	OpIntRat:    "int->rat",
+	OpFloatRat:  "float->rat",
+	OpRatInt:    "rat->int",
+	OpRatFloat:  "rat->float",
+	OpRatString: "rat->string",
+	OpRatNum:    "num/rat",
+	OpRatDenom:  "denom/rat",
+	OpRatNeg:    "neg/rat",
+	OpRatAbs:    "abs/rat",
+	OpRatInv:    "inv/rat",
+	OpRatAdd:    "+/rat",
+	OpRatSub:    "-/rat",
+	OpRatMul:    "*/rat",
+	OpRatDiv:    "//rat",
+	OpRatEq:     "==/rat",
+	OpRatNeq:    "!=/rat",
+	OpRatLess:   "</rat",
+	OpRatLessEq: "<=/rat",
+	OpRatMore:   ">/rat",
+	OpRatMoreEq: ">=/rat",
+	OpRatIsZero: "zero?/rat",
+
+	OpIntBigFloat:    "int->bigfloat",
+	OpFloatBigFloat:  "float->bigfloat",
+	OpRatBigFloat:    "rat->bigfloat",
+	OpBigFloatInt:    "bigfloat->int",
+	OpBigFloatFloat:  "bigfloat->float",
+	OpBigFloatRat:    "bigfloat->rat",
+	OpBigFloatString: "bigfloat->string",
+	OpBigFloatPrec:   "prec/bigfloat",
+	OpBigFloatNeg:    "neg/bigfloat",
+	OpBigFloatAbs:    "abs/bigfloat",
+	OpBigFloatAdd:    "+/bigfloat",
+	OpBigFloatSub:    "-/bigfloat",
+	OpBigFloatMul:    "*/bigfloat",
+	OpBigFloatDiv:    "//bigfloat",
+	OpBigFloatSqrt:   "sqrt/bigfloat",
+	OpBigFloatEq:     "==/bigfloat",
+	OpBigFloatNeq:    "!=/bigfloat",
+	OpBigFloatLess:   "</bigfloat",
+	OpBigFloatLessEq: "<=/bigfloat",
+	OpBigFloatMore:   ">/bigfloat",
+	OpBigFloatMoreEq: ">=/bigfloat",
+
+	OpStringInt:      "string->int",
+	OpStringFloat:    "string->float",
+	OpStringRat:      "string->rat",
+	OpStringBigFloat: "string->bigfloat",
+
+	OpRandNew:   "new/rand",
+	OpRandInt:   "int/rand",
+	OpRandFloat: "float/rand",
+	OpRandSplit: "split/rand",
 
 	OpError: "error",
 	OpDump:  "dump",
 }
 
+var BigFloatPrec uint = 128
+
 var bigOne = big.NewInt(1)
 
+func makeString(s string) Value {
+	runes := []rune(s)
+	chars := make([]Char, len(runes))
+	for i := range chars {
+		chars[i].Value = runes[i]
+	}
+	str := &Struct{Index: 0}
+	for i := len(runes) - 1; i >= 0; i-- {
+		str = &Struct{Index: 1, Values: []Value{str, &chars[i]}}
+	}
+	return str
+}
+
+func makeBool(b bool) Value {
+	if b {
+		return &nullaryStructs[0]
+	}
+	return &nullaryStructs[1]
+}
+
 func accumString(globals []Value, x Value) string {
 	var b strings.Builder
 	for str := x.(*Struct); str.Index != 0; str = Reduce(globals, str.Values[0]).(*Struct) {
@@ -348,16 +523,7 @@ func operator1(globals []Value, code int32, x Value) Value {
 		f, _ := new(big.Float).SetInt(&x.(*Int).Value).Float64()
 		return &Float{Value: f}
 	case OpIntString:
-		runes := []rune(x.(*Int).Value.Text(10))
-		chars := make([]Char, len(runes))
-		for i := range chars {
-			chars[i].Value = runes[i]
-		}
-		str := &Struct{Index: 0}
-		for i := len(runes) - 1; i >= 0; i-- {
-			str = &Struct{Index: 1, Values: []Value{str, &chars[i]}}
-		}
-		return str
+		return makeString(x.(*Int).Value.Text(10))
 	case OpIntNeg:
 		var y Int
 		y.Value.Neg(&x.(*Int).Value)
@@ -385,16 +551,7 @@ func operator1(globals []Value, code int32, x Value) Value {
 		big.NewFloat(math.Floor(x.(*Float).Value)).Int(&y.Value)
 		return &y
 	case OpFloatString:
-		runes := []rune(fmt.Sprint(x.(*Float).Value))
-		chars := make([]Char, len(runes))
-		for i := range chars {
-			chars[i].Value = runes[i]
-		}
-		str := &Struct{Index: 0}
-		for i := len(runes) - 1; i >= 0; i-- {
-			str = &Struct{Index: 1, Values: []Value{str, &chars[i]}}
-		}
-		return str
+		return makeString(fmt.Sprint(x.(*Float).Value))
 	case OpFloatNeg:
 		return &Float{Value: -x.(*Float).Value}
 	case OpFloatAbs:
@@ -460,6 +617,93 @@ func operator1(globals []Value, code int32, x Value) Value {
 	case OpFloatGamma:
 		return &Float{Value: math.Gamma(x.(*Float).Value)}
 
+	case OpIntRat:
+		var y Rat
+		y.Value.SetInt(&x.(*Int).Value)
+		return &y
+	case OpFloatRat:
+		var y Rat
+		y.Value.SetFloat64(x.(*Float).Value)
+		return &y
+	case OpRatInt:
+		var y, m Int
+		y.Value.DivMod(x.(*Rat).Value.Num(), x.(*Rat).Value.Denom(), &m.Value)
+		return &y
+	case OpRatFloat:
+		f, _ := x.(*Rat).Value.Float64()
+		return &Float{Value: f}
+	case OpRatString:
+		return makeString(x.(*Rat).Value.RatString())
+	case OpRatNum:
+		var y Int
+		y.Value.Set(x.(*Rat).Value.Num())
+		return &y
+	case OpRatDenom:
+		var y Int
+		y.Value.Set(x.(*Rat).Value.Denom())
+		return &y
+	case OpRatNeg:
+		var y Rat
+		y.Value.Neg(&x.(*Rat).Value)
+		return &y
+	case OpRatAbs:
+		var y Rat
+		y.Value.Abs(&x.(*Rat).Value)
+		return &y
+	case OpRatInv:
+		var y Rat
+		y.Value.Inv(&x.(*Rat).Value)
+		return &y
+	case OpRatIsZero:
+		return makeBool(x.(*Rat).Value.Sign() == 0)
+
+	case OpIntBigFloat:
+		var y BigFloat
+		y.Value.SetPrec(BigFloatPrec).SetInt(&x.(*Int).Value)
+		return &y
+	case OpFloatBigFloat:
+		var y BigFloat
+		y.Value.SetPrec(BigFloatPrec).SetFloat64(x.(*Float).Value)
+		return &y
+	case OpRatBigFloat:
+		var y BigFloat
+		y.Value.SetPrec(BigFloatPrec).SetRat(&x.(*Rat).Value)
+		return &y
+	case OpBigFloatInt:
+		var y Int
+		xf := &x.(*BigFloat).Value
+		if xf.IsInf() {
+			panic("bigfloat->int: infinite value")
+		}
+		if _, acc := xf.Int(&y.Value); acc == big.Above {
+			y.Value.Sub(&y.Value, bigOne)
+		}
+		return &y
+	case OpBigFloatFloat:
+		f, _ := x.(*BigFloat).Value.Float64()
+		return &Float{Value: f}
+	case OpBigFloatRat:
+		var y Rat
+		if x.(*BigFloat).Value.IsInf() {
+			panic("bigfloat->rat: infinite value")
+		}
+		x.(*BigFloat).Value.Rat(&y.Value)
+		return &y
+	case OpBigFloatString:
+		return makeString(x.(*BigFloat).Value.Text('g', -1))
+	case OpBigFloatNeg:
+		var y BigFloat
+		y.Value.Neg(&x.(*BigFloat).Value)
+		return &y
+	case OpBigFloatAbs:
+		var y BigFloat
+		y.Value.Abs(&x.(*BigFloat).Value)
+		return &y
+	case OpBigFloatSqrt:
+		var y BigFloat
+		y.Value.Sqrt(&x.(*BigFloat).Value)
+		return &y
+
 	case OpStringInt:
 		var i Int
 		fmt.Sscan(accumString(globals, x), &i.Value)
@@ -468,6 +712,31 @@ func operator1(globals []Value, code int32, x Value) Value {
 		var f Float
 		fmt.Sscan(accumString(globals, x), &f.Value)
 		return &f
+	case OpStringRat:
+		var r Rat
+		r.Value.SetString(accumString(globals, x))
+		return &r
+	case OpStringBigFloat:
+		var f BigFloat
+		f.Value.SetPrec(BigFloatPrec).SetString(accumString(globals, x))
+		return &f
+
+	case OpRandNew:
+		var seed big.Int
+		seed.And(&x.(*Int).Value, mask64)
+		return encodeRand(seed.Uint64(), goldenGamma)
+	case OpRandFloat:
+		seed, gamma := decodeRand(x.(*Int))
+		seed += gamma
+		f := float64(mix64(seed)>>11) / (1 << 53)
+		return &Struct{Index: 0, Values: []Value{encodeRand(seed, gamma), &Float{Value: f}}}
+	case OpRandSplit:
+		seed, gamma := decodeRand(x.(*Int))
+		seed += gamma
+		childSeed := mix64(seed)
+		seed += gamma
+		childGamma := mixGamma(seed)
+		return &Struct{Index: 0, Values: []Value{encodeRand(childSeed, childGamma), encodeRand(seed, gamma)}}
 
 	case OpError:
 		fmt.Fprintf(os.Stderr, "ERROR: %s\n", accumString(globals, x))
@@ -633,6 +902,78 @@ func operator2(globals []Value, code int32, x, y Value) Value {
 		xf, yf := x.(*Float).Value, y.(*Float).Value
 		return &Float{Value: math.Hypot(xf, yf)}
 
+	case OpRatAdd:
+		var z Rat
+		z.Value.Add(&x.(*Rat).Value, &y.(*Rat).Value)
+		return &z
+	case OpRatSub:
+		var z Rat
+		z.Value.Sub(&x.(*Rat).Value, &y.(*Rat).Value)
+		return &z
+	case OpRatMul:
+		var z Rat
+		z.Value.Mul(&x.(*Rat).Value, &y.(*Rat).Value)
+		return &z
+	case OpRatDiv:
+		var z Rat
+		z.Value.Quo(&x.(*Rat).Value, &y.(*Rat).Value)
+		return &z
+	case OpRatEq:
+		return makeBool(x.(*Rat).Value.Cmp(&y.(*Rat).Value) == 0)
+	case OpRatNeq:
+		return makeBool(x.(*Rat).Value.Cmp(&y.(*Rat).Value) != 0)
+	case OpRatLess:
+		return makeBool(x.(*Rat).Value.Cmp(&y.(*Rat).Value) < 0)
+	case OpRatLessEq:
+		return makeBool(x.(*Rat).Value.Cmp(&y.(*Rat).Value) <= 0)
+	case OpRatMore:
+		return makeBool(x.(*Rat).Value.Cmp(&y.(*Rat).Value) > 0)
+	case OpRatMoreEq:
+		return makeBool(x.(*Rat).Value.Cmp(&y.(*Rat).Value) >= 0)
+
+	case OpBigFloatPrec:
+		var z BigFloat
+		z.Value.SetPrec(uint(y.(*Int).Value.Uint64())).Set(&x.(*BigFloat).Value)
+		return &z
+	case OpBigFloatAdd:
+		var z BigFloat
+		z.Value.Add(&x.(*BigFloat).Value, &y.(*BigFloat).Value)
+		return &z
+	case OpBigFloatSub:
+		var z BigFloat
+		z.Value.Sub(&x.(*BigFloat).Value, &y.(*BigFloat).Value)
+		return &z
+	case OpBigFloatMul:
+		var z BigFloat
+		z.Value.Mul(&x.(*BigFloat).Value, &y.(*BigFloat).Value)
+		return &z
+	case OpBigFloatDiv:
+		var z BigFloat
+		z.Value.Quo(&x.(*BigFloat).Value, &y.(*BigFloat).Value)
+		return &z
+	case OpBigFloatEq:
+		return makeBool(x.(*BigFloat).Value.Cmp(&y.(*BigFloat).Value) == 0)
+	case OpBigFloatNeq:
+		return makeBool(x.(*BigFloat).Value.Cmp(&y.(*BigFloat).Value) != 0)
+	case OpBigFloatLess:
+		return makeBool(x.(*BigFloat).Value.Cmp(&y.(*BigFloat).Value) < 0)
+	case OpBigFloatLessEq:
+		return makeBool(x.(*BigFloat).Value.Cmp(&y.(*BigFloat).Value) <= 0)
+	case OpBigFloatMore:
+		return makeBool(x.(*BigFloat).Value.Cmp(&y.(*BigFloat).Value) > 0)
+	case OpBigFloatMoreEq:
+		return makeBool(x.(*BigFloat).Value.Cmp(&y.(*BigFloat).Value) >= 0)
+
+	case OpRandInt:
+		n := &x.(*Int).Value
+		if n.Sign() <= 0 {
+			panic("int/rand: bound must be positive")
+		}
+		seed, gamma := decodeRand(y.(*Int))
+		var z Int
+		seed = randBelow(&z.Value, n, seed, gamma)
+		return &Struct{Index: 0, Values: []Value{encodeRand(seed, gamma), &z}}
+
 	case OpDump:
 		fmt.Fprintln(os.Stderr, accumString(globals, x))
 		return Reduce(globals, y)
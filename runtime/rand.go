@@ -0,0 +1,76 @@
+package runtime
+
+import (
+	"math/big"
+	"math/bits"
+)
+
+// Random generators are SplitMix64 (Steele, Lea, Flood: Fast Splittable Pseudorandom Number
+// Generators) states encoded in a single Int: the low 64 bits are the seed, the next 64 bits
+// are the gamma. The gamma must be odd, so its lowest bit is always set when decoding and an
+// Int with zero gamma uses the golden gamma, which makes any Int a valid generator.
+//
+// The operators return pairs as structs with the constructor index 0: int/rand and float/rand
+// give the number as field 0 and the advanced generator as field 1, split/rand gives the
+// advanced generator as field 0 and the new independent generator as field 1.
+
+const goldenGamma = 0x9e3779b97f4a7c15
+
+var mask64 = new(big.Int).SetUint64(1<<64 - 1)
+
+func mix64(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func mixGamma(z uint64) uint64 {
+	z = (z ^ (z >> 33)) * 0xff51afd7ed558ccd
+	z = (z ^ (z >> 33)) * 0xc4ceb9fe1a85ec53
+	z = (z ^ (z >> 33)) | 1
+	if bits.OnesCount64(z^(z>>1)) < 24 {
+		return z ^ 0xaaaaaaaaaaaaaaaa
+	}
+	return z
+}
+
+func encodeRand(seed, gamma uint64) *Int {
+	var r Int
+	r.Value.SetUint64(gamma)
+	r.Value.Lsh(&r.Value, 64)
+	r.Value.Or(&r.Value, new(big.Int).SetUint64(seed))
+	return &r
+}
+
+func decodeRand(r *Int) (seed, gamma uint64) {
+	var x big.Int
+	x.And(&r.Value, mask64)
+	seed = x.Uint64()
+	x.Rsh(&r.Value, 64)
+	x.And(&x, mask64)
+	gamma = x.Uint64()
+	if gamma == 0 {
+		gamma = goldenGamma
+	}
+	return seed, gamma | 1
+}
+
+// randBelow sets z to a uniformly distributed integer in [0, n) by rejection sampling
+// and returns the advanced seed.
+func randBelow(z, n *big.Int, seed, gamma uint64) uint64 {
+	var word big.Int
+	chunks := (n.BitLen() + 63) / 64
+	for {
+		z.SetUint64(0)
+		for i := 0; i < chunks; i++ {
+			seed += gamma
+			word.SetUint64(mix64(seed))
+			z.Lsh(z, 64)
+			z.Or(z, &word)
+		}
+		z.Rsh(z, uint(chunks*64-n.BitLen()))
+		if z.Cmp(n) < 0 {
+			return seed
+		}
+	}
+}
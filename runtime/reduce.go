@@ -1,5 +1,7 @@
 package runtime
 
+import "fmt"
+
 var (
 	Reductions = 0
 	Stacks     = 0
@@ -76,7 +78,7 @@ func Reduce(globals []Value, value Value, args ...Value) (result Value) {
 
 beginning:
 	switch v := value.(type) {
-	case *Char, *Int, *Float, *Struct:
+	case *Char, *Int, *Float, *Rat, *BigFloat, *Struct, *Foreign:
 		if len(stack) > 0 {
 			panic("not empty stack")
 		}
@@ -88,14 +90,17 @@ beginning:
 			result = v.Result
 			goto end
 		}
-		if v.Code == nil {
+		if reducing(v) {
+			if v.Code.Source != nil {
+				panic(fmt.Sprintf("infinite reduction of %s", v.Code.Source.Global))
+			}
 			panic("infinite reduction")
 		}
 
 		code, data := v.Code, v.Data
 		if len(stack) == 0 {
 			shares = append(shares, v)
-			v.Code, v.Data = nil, nil
+			v.Data = blackhole
 		}
 
 		for {
@@ -108,20 +113,30 @@ beginning:
 
 			case CodeOperator:
 				if len(stack) != operatorArity[code.X] {
-					panic("wrong number of operands on stack")
+					fail(code, "wrong number of operands on stack")
+				}
+				if code.X >= hostBase {
+					args := make([]Value, len(stack))
+					for i := range args {
+						args[i] = stack[len(stack)-i-1]
+					}
+					putStack(stack)
+					putStack(fastData)
+					result = operateHost(globals, code, args)
+					goto operatorEnd
 				}
 				switch operatorArity[code.X] {
 				case 1:
 					x := stack[0]
 					putStack(stack)
 					putStack(fastData)
-					result = operator1(globals, code.X, x)
+					result = operate(globals, code, x, nil)
 					goto operatorEnd
 				case 2:
 					x, y := stack[1], stack[0]
 					putStack(stack)
 					putStack(fastData)
-					result = operator2(globals, code.X, x, y)
+					result = operate(globals, code, x, y)
 					goto operatorEnd
 				default:
 					panic("invalid arity")
@@ -157,7 +172,7 @@ beginning:
 
 			case CodeAbst:
 				if int32(len(stack)) < code.X {
-					panic("not enough arguments on stack")
+					fail(code, "not enough arguments on stack")
 				}
 				Datas++
 				pop := int32(len(stack)) - code.X
@@ -168,7 +183,7 @@ beginning:
 
 			case CodeFastAbst:
 				if int32(len(stack)) < code.X {
-					panic("not enough arguments on stack")
+					fail(code, "not enough arguments on stack")
 				}
 				pop := int32(len(stack)) - code.X
 				data = append(fastData[:0], stack[pop:]...)
@@ -183,6 +198,8 @@ beginning:
 					case CodeVar:
 						index := int32(len(data)) - code.Table[i].X - 1
 						stack = append(stack, data[index])
+					case CodeGlobal:
+						stack = append(stack, globals[code.Table[i].X])
 					case CodeStrict:
 						thunk := getThunk()
 						thunk.Result = nil
@@ -190,6 +207,11 @@ beginning:
 						thunk.Data = data
 						stack = append(stack, Reduce(globals, thunk))
 						putThunk(thunk)
+					case CodeClosure:
+						Thunks++
+						stack = append(stack, &Thunk{Code: &code.Table[i].Table[0], Data: capture(&code.Table[i], data)})
+					case CodeSelect:
+						stack = append(stack, selector(&code.Table[i], data))
 					default:
 						Thunks++
 						stack = append(stack, &Thunk{Code: &code.Table[i], Data: data})
@@ -197,9 +219,82 @@ beginning:
 				}
 				code = &code.Table[0]
 
+			case CodeLet:
+				Datas++
+				n := len(code.Table) - 1
+				letData := make([]Value, n+len(data))
+				copy(letData[n:], data)
+				for i := 1; i <= n; i++ {
+					switch code.Table[i].Kind {
+					case CodeValue:
+						letData[n-i] = code.Table[i].Value
+					case CodeVar:
+						index := int32(len(data)) - code.Table[i].X - 1
+						letData[n-i] = data[index]
+					case CodeGlobal:
+						letData[n-i] = globals[code.Table[i].X]
+					case CodeStrict:
+						thunk := getThunk()
+						thunk.Result = nil
+						thunk.Code = &code.Table[i].Table[0]
+						thunk.Data = data
+						letData[n-i] = Reduce(globals, thunk)
+						putThunk(thunk)
+					case CodeClosure:
+						Thunks++
+						letData[n-i] = &Thunk{Code: &code.Table[i].Table[0], Data: capture(&code.Table[i], data)}
+					case CodeSelect:
+						letData[n-i] = selector(&code.Table[i], data)
+					default:
+						Thunks++
+						letData[n-i] = &Thunk{Code: &code.Table[i], Data: data}
+					}
+				}
+				data = letData
+				code = &code.Table[0]
+
+			case CodeLetRec:
+				Datas++
+				n := len(code.Table) - 1
+				letData := make([]Value, n+len(data))
+				copy(letData[n:], data)
+				for i := 1; i <= n; i++ {
+					switch code.Table[i].Kind {
+					case CodeValue:
+						letData[n-i] = code.Table[i].Value
+					case CodeGlobal:
+						letData[n-i] = globals[code.Table[i].X]
+					case CodeClosure:
+						// captured after all the thunks exist, they may refer to each other
+						Thunks++
+						letData[n-i] = &Thunk{Code: &code.Table[i].Table[0]}
+					default:
+						Thunks++
+						letData[n-i] = &Thunk{Code: &code.Table[i], Data: letData}
+					}
+				}
+				for i := 1; i <= n; i++ {
+					if code.Table[i].Kind == CodeClosure {
+						letData[n-i].(*Thunk).Data = capture(&code.Table[i], letData)
+					}
+				}
+				data = letData
+				code = &code.Table[0]
+
 			case CodeStrict:
 				code = &code.Table[0]
 
+			case CodeClosure:
+				data = capture(code, data)
+				code = &code.Table[0]
+
+			case CodeSelect:
+				// selector thunks hold just the struct
+				str := Reduce(globals, data[0]).(*Struct)
+				index := int32(len(str.Values)) - code.X - 1
+				value = str.Values[index]
+				goto beginning
+
 			case CodeSwitch:
 				thunk := getThunk()
 				thunk.Result = nil
@@ -207,8 +302,41 @@ beginning:
 				thunk.Data = data
 				str := Reduce(globals, thunk).(*Struct)
 				putThunk(thunk)
-				stack = append(stack, str.Values...)
-				code = &code.Table[str.Index+1]
+				switch {
+				case str.Index < code.X:
+					stack = append(stack, str.Values...)
+					code = &code.Table[str.Index+1]
+				case int(code.X)+1 < len(code.Table):
+					code = &code.Table[code.X+1]
+				default:
+					fail(code, "no case for constructor %d in switch", str.Index)
+				}
+
+			case CodeMatch:
+				thunk := getThunk()
+				thunk.Result = nil
+				thunk.Code = &code.Table[0]
+				thunk.Data = data
+				key := Reduce(globals, thunk)
+				putThunk(thunk)
+				n := int(code.X)
+				lo, hi := 0, n
+				for lo < hi {
+					mid := (lo + hi) / 2
+					if compareKeys(code.Table[1+mid].Value, key) < 0 {
+						lo = mid + 1
+					} else {
+						hi = mid
+					}
+				}
+				switch {
+				case lo < n && compareKeys(code.Table[1+lo].Value, key) == 0:
+					code = &code.Table[1+n+lo]
+				case len(code.Table) > 1+2*n:
+					code = &code.Table[1+2*n]
+				default:
+					fail(code, "no case for %v in match", key)
+				}
 			}
 		}
 
@@ -222,7 +350,133 @@ end:
 operatorEnd:
 	for _, share := range shares {
 		share.Result = result
+		share.Code, share.Data = nil, nil
 	}
 	putShares(shares)
 	return result
 }
+
+// blackhole is the data of the thunks being reduced. Their code stays, so that an infinite
+// reduction can tell where it happened.
+var blackhole = []Value{nil}
+
+func reducing(t *Thunk) bool {
+	return len(t.Data) == 1 && &t.Data[0] == &blackhole[0]
+}
+
+// operate applies a builtin operator to its operands, y is nil for unary operators. When the
+// code has a source, the operands are reduced first, so that only the failures of the operator
+// itself get its location.
+func operate(globals []Value, code *Code, x, y Value) Value {
+	unary := operatorArity[code.X] == 1
+	if code.Source != nil && code.X != OpDump {
+		x = Reduce(globals, x)
+		if !unary {
+			y = Reduce(globals, y)
+		}
+		return operateAt(globals, code, x, y, unary)
+	}
+	if unary {
+		return operator1(globals, code.X, x)
+	}
+	return operator2(globals, code.X, x, y)
+}
+
+func operateAt(globals []Value, code *Code, x, y Value, unary bool) Value {
+	defer locate(code)
+	if unary {
+		return operator1(globals, code.X, x)
+	}
+	return operator2(globals, code.X, x, y)
+}
+
+func operateHost(globals []Value, code *Code, args []Value) Value {
+	if code.Source == nil {
+		return operatorHost(globals, code.X, args)
+	}
+	op := &hostOperators[code.X-hostBase]
+	for i := range args {
+		if op.strict[i] {
+			args[i] = Reduce(globals, args[i])
+		}
+	}
+	return Reduce(globals, callHost(globals, code, op, args))
+}
+
+func callHost(globals []Value, code *Code, op *hostOperator, args []Value) Value {
+	defer locate(code)
+	return op.fn(globals, args)
+}
+
+// capture copies the variables captured by a closure into a fresh data slice, so that the
+// thunk doesn't keep the rest of the data alive.
+func capture(code *Code, data []Value) []Value {
+	if code.X == 0 {
+		return nil
+	}
+	Datas++
+	captured := make([]Value, code.X)
+	for j := int32(0); j < code.X; j++ {
+		captured[code.X-j-1] = settle(data[int32(len(data))-code.Table[1+j].X-1])
+	}
+	return captured
+}
+
+// selector returns the field selected by a CodeSelect from a struct variable right away if the
+// struct is already evaluated. Otherwise it returns a selector thunk holding only the struct.
+func selector(code *Code, data []Value) Value {
+	x := data[int32(len(data))-code.Table[0].X-1]
+	if field, ok := selectField(x, code.X); ok {
+		return field
+	}
+	Thunks++
+	return &Thunk{Code: code, Data: []Value{x}}
+}
+
+// settle skips evaluated thunks and selector thunks whose struct got evaluated in the meantime,
+// so that they don't keep the struct alive.
+func settle(x Value) Value {
+	t, ok := x.(*Thunk)
+	if !ok {
+		return x
+	}
+	if t.Result != nil {
+		return t.Result
+	}
+	if t.Code != nil && t.Code.Kind == CodeSelect {
+		if field, ok := selectField(t.Data[0], t.Code.X); ok {
+			return field
+		}
+	}
+	return x
+}
+
+func selectField(x Value, index int32) (Value, bool) {
+	if t, ok := x.(*Thunk); ok && t.Result != nil {
+		x = t.Result
+	}
+	str, ok := x.(*Struct)
+	if !ok || index >= int32(len(str.Values)) {
+		return nil, false
+	}
+	return str.Values[int32(len(str.Values))-index-1], true
+}
+
+func compareKeys(x, y Value) int {
+	switch x := x.(type) {
+	case *Char:
+		y := y.(*Char)
+		switch {
+		case x.Value < y.Value:
+			return -1
+		case x.Value > y.Value:
+			return +1
+		default:
+			return 0
+		}
+	case *Int:
+		return x.Value.Cmp(&y.(*Int).Value)
+	default:
+		panic("invalid match key")
+	}
+}
@@ -9,6 +9,9 @@ func (c *Char) String() string  { return fmt.Sprintf("%q", c.Value) }
 func (i *Int) String() string   { return fmt.Sprint(&i.Value) }
 func (f *Float) String() string { return fmt.Sprint(f.Value) }
 
+func (r *Rat) String() string      { return r.Value.RatString() }
+func (f *BigFloat) String() string { return f.Value.Text('g', -1) }
+
 func (s *Struct) String() string {
 	var b strings.Builder
 	fmt.Fprintf(&b, "{/%d", s.Index)
@@ -20,6 +23,13 @@ func (s *Struct) String() string {
 	return b.String()
 }
 
+func (f *Foreign) String() string {
+	if s, ok := f.Value.(fmt.Stringer); ok {
+		return fmt.Sprintf("<%T %s>", f.Value, s)
+	}
+	return fmt.Sprintf("<%T>", f.Value)
+}
+
 func (t *Thunk) String() string {
 	if t.Result != nil {
 		return t.Result.String()
@@ -47,6 +57,17 @@ func indented(level int, c *Code, b *strings.Builder) {
 	}
 }
 
+func (k CodeKind) String() string {
+	if !k.Valid() {
+		return fmt.Sprintf("CodeKind(%d)", int32(k))
+	}
+	return codeNames[k]
+}
+
+func (k CodeKind) Valid() bool {
+	return k >= 0 && int(k) < len(codeNames)
+}
+
 var codeNames = [...]string{
 	CodeValue:    "VALUE",
 	CodeOperator: "OPERATOR",
@@ -57,6 +78,11 @@ var codeNames = [...]string{
 	CodeAbst:     "ABST",
 	CodeFastAbst: "FASTABST",
 	CodeAppl:     "APPL",
+	CodeLet:      "LET",
+	CodeLetRec:   "LETREC",
 	CodeStrict:   "STRICT",
 	CodeSwitch:   "SWITCH",
+	CodeMatch:    "MATCH",
+	CodeClosure:  "CLOSURE",
+	CodeSelect:   "SELECT",
 }
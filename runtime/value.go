@@ -11,11 +11,16 @@ type (
 	Int   struct{ Value big.Int }
 	Float struct{ Value float64 }
 
+	Rat      struct{ Value big.Rat }
+	BigFloat struct{ Value big.Float }
+
 	Struct struct {
 		Index  int32
 		Values []Value
 	}
 
+	Foreign struct{ Value interface{} }
+
 	Thunk struct {
 		Result Value
 		Code   *Code
@@ -24,10 +29,11 @@ type (
 )
 
 type Code struct {
-	Kind  CodeKind
-	X     int32
-	Table []Code
-	Value Value
+	Kind   CodeKind
+	X      int32
+	Table  []Code
+	Value  Value
+	Source *Source
 }
 
 type CodeKind int32
@@ -42,6 +48,11 @@ const (
 	CodeAbst
 	CodeFastAbst
 	CodeAppl
+	CodeLet
+	CodeLetRec
 	CodeStrict
 	CodeSwitch
+	CodeMatch
+	CodeClosure
+	CodeSelect
 )
@@ -47,6 +47,33 @@ func (a *Appl) String() string {
 	return b.String()
 }
 
+func (l *Let) String() string {
+	return letString("#let", l.Bound, l.Values, l.Body)
+}
+
+func (l *LetRec) String() string {
+	return letString("#letrec", l.Bound, l.Values, l.Body)
+}
+
+func letString(keyword string, bound []string, values []Expr, body Expr) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	b.WriteString(keyword)
+	for i := range bound {
+		b.WriteString(" [")
+		b.WriteString(bound[i])
+		b.WriteByte(' ')
+		b.WriteString(values[i].String())
+		b.WriteByte(']')
+	}
+	b.WriteString(" -> ")
+	b.WriteString(body.String())
+	b.WriteByte(')')
+	return b.String()
+}
+
+func (a *Annotated) String() string { return a.Expr.String() }
+
 func (s *Strict) String() string {
 	var b strings.Builder
 	b.WriteByte('{')
@@ -63,6 +90,31 @@ func (s *Switch) String() string {
 		b.WriteByte(' ')
 		b.WriteString(cas.String())
 	}
+	if s.Default != nil {
+		b.WriteString(" [#default ")
+		b.WriteString(s.Default.String())
+		b.WriteByte(']')
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+func (m *Match) String() string {
+	var b strings.Builder
+	b.WriteString("(#match ")
+	b.WriteString(m.Expr.String())
+	for i := range m.Keys {
+		b.WriteString(" [")
+		b.WriteString(m.Keys[i].String())
+		b.WriteByte(' ')
+		b.WriteString(m.Cases[i].String())
+		b.WriteByte(']')
+	}
+	if m.Default != nil {
+		b.WriteString(" [#default ")
+		b.WriteString(m.Default.String())
+		b.WriteByte(']')
+	}
 	b.WriteByte(')')
 	return b.String()
 }
@@ -0,0 +1,286 @@
+package crux
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/faiface/crux/runtime"
+)
+
+// Problem is a single defect found by Validate. Global is the name and overload index of the
+// definition, Path leads from the definition to the offending node, e.g. Body.Rands[1].
+type Problem struct {
+	Global string
+	Path   string
+	Msg    string
+}
+
+func (p *Problem) Error() string {
+	if p.Path == "" {
+		return fmt.Sprintf("%s: %s", p.Global, p.Msg)
+	}
+	return fmt.Sprintf("%s at %s: %s", p.Global, p.Path, p.Msg)
+}
+
+type Problems []*Problem
+
+func (ps Problems) Error() string {
+	var b strings.Builder
+	for i, p := range ps {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(p.Error())
+	}
+	return b.String()
+}
+
+// Validate checks that the globals are well-formed and can be compiled. It returns all problems
+// it finds as Problems, or nil if there are none.
+func Validate(globals map[string][]Expr) error {
+	var (
+		problems Problems
+		global   string
+	)
+
+	report := func(path string, format string, args ...interface{}) {
+		problems = append(problems, &Problem{
+			Global: global,
+			Path:   path,
+			Msg:    fmt.Sprintf(format, args...),
+		})
+	}
+
+	join := func(path, field string) string {
+		if path == "" {
+			return field
+		}
+		return path + "." + field
+	}
+
+	checkBound := func(path string, bound []string) {
+		seen := make(map[string]bool)
+		for _, name := range bound {
+			if seen[name] {
+				report(path, "%s bound twice", name)
+			}
+			seen[name] = true
+		}
+	}
+
+	var validate func(path string, locals []string, e Expr)
+	validate = func(path string, locals []string, e Expr) {
+		switch e := e.(type) {
+		case nil:
+			report(path, "missing expression")
+
+		case *Char, *Int, *Float:
+
+		case *Operator:
+			if runtime.OperatorArity(e.Code) < 0 {
+				report(path, "wrong operator code %d", e.Code)
+			}
+
+		case *Make:
+			if e.Index < 0 {
+				report(path, "negative constructor index %d", e.Index)
+			}
+
+		case *Field:
+			if e.Index < 0 {
+				report(path, "negative field index %d", e.Index)
+			}
+
+		case *Var:
+			if e.Index >= 0 {
+				if e.Index >= int32(len(globals[e.Name])) {
+					report(path, "%v not defined", e)
+				}
+				return
+			}
+			for i := len(locals) - 1; i >= 0; i-- {
+				if locals[i] == e.Name {
+					return
+				}
+			}
+			report(path, "%s not bound", e.Name)
+
+		case *Abst:
+			checkBound(path, e.Bound)
+			validate(join(path, "Body"), e.Bound, e.Body)
+
+		case *Appl:
+			rator, rands := Spine(e)
+			switch rator := Unannotate(rator).(type) {
+			case *Operator:
+				arity := runtime.OperatorArity(rator.Code)
+				if arity >= 0 && len(rands) > arity {
+					report(path, "operator %v takes %d arguments, got %d", rator, arity, len(rands))
+				}
+			case *Field:
+				if len(rands) > 0 {
+					if size, ok := structSize(rands[0]); ok && rator.Index >= size {
+						report(path, "field %d of a struct with %d fields", rator.Index, size)
+					}
+				}
+			}
+			// nested rators are part of the same spine, so they don't get checked again
+			for appl := e; ; {
+				for i, rand := range appl.Rands {
+					validate(join(path, fmt.Sprintf("Rands[%d]", i)), locals, rand)
+				}
+				path = join(path, "Rator")
+				next, ok := appl.Rator.(*Appl)
+				if !ok {
+					validate(path, locals, appl.Rator)
+					break
+				}
+				appl = next
+			}
+
+		case *Let:
+			checkBound(path, e.Bound)
+			if len(e.Bound) != len(e.Values) {
+				report(path, "%d names bound to %d values", len(e.Bound), len(e.Values))
+			}
+			for i, value := range e.Values {
+				validate(join(path, fmt.Sprintf("Values[%d]", i)), locals, value)
+			}
+			validate(join(path, "Body"), extend(locals, e.Bound), e.Body)
+
+		case *LetRec:
+			checkBound(path, e.Bound)
+			if len(e.Bound) != len(e.Values) {
+				report(path, "%d names bound to %d values", len(e.Bound), len(e.Values))
+			}
+			recLocals := extend(locals, e.Bound)
+			for i, value := range e.Values {
+				valuePath := join(path, fmt.Sprintf("Values[%d]", i))
+				if _, ok := Unannotate(value).(*Strict); ok {
+					report(valuePath, "strict value in a recursive binding")
+				}
+				validate(valuePath, recLocals, value)
+			}
+			validate(join(path, "Body"), recLocals, e.Body)
+
+		case *Strict:
+			validate(join(path, "Expr"), locals, e.Expr)
+
+		case *Annotated:
+			validate(join(path, "Expr"), locals, e.Expr)
+
+		case *Switch:
+			if index, ok := constructorIndex(e.Expr); ok && index >= int32(len(e.Cases)) && e.Default == nil {
+				report(path, "no case for constructor %d", index)
+			}
+			validate(join(path, "Expr"), locals, e.Expr)
+			for i, cas := range e.Cases {
+				validate(join(path, fmt.Sprintf("Cases[%d]", i)), locals, cas)
+			}
+			if e.Default != nil {
+				validate(join(path, "Default"), locals, e.Default)
+			}
+
+		case *Match:
+			if len(e.Keys) != len(e.Cases) {
+				report(path, "%d keys for %d cases", len(e.Keys), len(e.Cases))
+			}
+			var kind string
+			seen := make(map[string]bool)
+			for i, key := range e.Keys {
+				keyPath := join(path, fmt.Sprintf("Keys[%d]", i))
+				var keyKind string
+				switch key.(type) {
+				case *Char:
+					keyKind = "char"
+				case *Int:
+					keyKind = "int"
+				default:
+					report(keyPath, "%v is not a valid match key", key)
+					continue
+				}
+				if kind == "" {
+					kind = keyKind
+				}
+				if keyKind != kind {
+					report(keyPath, "%s key among %s keys", keyKind, kind)
+					continue
+				}
+				if seen[key.String()] {
+					report(keyPath, "duplicate key %v", key)
+				}
+				seen[key.String()] = true
+			}
+			validate(join(path, "Expr"), locals, e.Expr)
+			for i, cas := range e.Cases {
+				validate(join(path, fmt.Sprintf("Cases[%d]", i)), locals, cas)
+			}
+			if e.Default != nil {
+				validate(join(path, "Default"), locals, e.Default)
+			}
+
+		default:
+			report(path, "unknown expression %T", e)
+		}
+	}
+
+	names := make([]string, 0, len(globals))
+	for name := range globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for index, e := range globals[name] {
+			global = fmt.Sprintf("%s/%d", name, index)
+			validate("", nil, e)
+		}
+	}
+
+	// the program is well-formed, so it can be analyzed
+	if len(problems) == 0 {
+		for _, cycle := range CAFCycles(globals) {
+			global = cycle[0].String()
+			report("", "infinite reduction, %s", formatPath(cycle))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+// Spine collects the rands of nested applications, (((f a) b) c) gives f and [a b c].
+func Spine(e Expr) (rator Expr, rands []Expr) {
+	var appls []*Appl
+	for {
+		appl, ok := e.(*Appl)
+		if !ok {
+			break
+		}
+		appls = append(appls, appl)
+		e = appl.Rator
+	}
+	for i := len(appls) - 1; i >= 0; i-- {
+		rands = append(rands, appls[i].Rands...)
+	}
+	return e, rands
+}
+
+func constructorIndex(e Expr) (index int32, ok bool) {
+	rator, _ := Spine(e)
+	if mk, ok := rator.(*Make); ok {
+		return mk.Index, true
+	}
+	return 0, false
+}
+
+func structSize(e Expr) (size int32, ok bool) {
+	rator, rands := Spine(e)
+	if _, ok := rator.(*Make); ok {
+		return int32(len(rands)), true
+	}
+	return 0, false
+}
@@ -0,0 +1,397 @@
+package crux
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Children returns the direct subexpressions of e in the order of their fields,
+// a missing Default is left out.
+func Children(e Expr) []Expr {
+	switch e := e.(type) {
+	case *Char, *Int, *Float, *Operator, *Make, *Field, *Var:
+		return nil
+	case *Abst:
+		return []Expr{e.Body}
+	case *Appl:
+		children := make([]Expr, 0, 1+len(e.Rands))
+		children = append(children, e.Rator)
+		return append(children, e.Rands...)
+	case *Let:
+		children := make([]Expr, 0, len(e.Values)+1)
+		children = append(children, e.Values...)
+		return append(children, e.Body)
+	case *LetRec:
+		children := make([]Expr, 0, len(e.Values)+1)
+		children = append(children, e.Values...)
+		return append(children, e.Body)
+	case *Strict:
+		return []Expr{e.Expr}
+	case *Annotated:
+		return []Expr{e.Expr}
+	case *Switch:
+		children := make([]Expr, 0, 2+len(e.Cases))
+		children = append(children, e.Expr)
+		children = append(children, e.Cases...)
+		if e.Default != nil {
+			children = append(children, e.Default)
+		}
+		return children
+	case *Match:
+		children := make([]Expr, 0, 2+len(e.Keys)+len(e.Cases))
+		children = append(children, e.Expr)
+		children = append(children, e.Keys...)
+		children = append(children, e.Cases...)
+		if e.Default != nil {
+			children = append(children, e.Default)
+		}
+		return children
+	default:
+		panic(fmt.Sprintf("unknown expression %T", e))
+	}
+}
+
+// WithChildren returns a shallow copy of e with its children replaced by the given ones,
+// which must be in the order of Children. The new slices are capped, so appending to one
+// doesn't overwrite the next.
+func WithChildren(e Expr, children []Expr) Expr {
+	switch e := e.(type) {
+	case *Char, *Int, *Float, *Operator, *Make, *Field, *Var:
+		return e
+	case *Abst:
+		return &Abst{Bound: e.Bound, Body: children[0]}
+	case *Appl:
+		return &Appl{Rator: children[0], Rands: children[1:len(children):len(children)]}
+	case *Let:
+		n := len(e.Values)
+		return &Let{Bound: e.Bound, Values: children[:n:n], Body: children[n]}
+	case *LetRec:
+		n := len(e.Values)
+		return &LetRec{Bound: e.Bound, Values: children[:n:n], Body: children[n]}
+	case *Strict:
+		return &Strict{Expr: children[0]}
+	case *Annotated:
+		return &Annotated{Pos: e.Pos, Expr: children[0]}
+	case *Switch:
+		n := len(e.Cases)
+		s := &Switch{Expr: children[0], Cases: children[1 : 1+n : 1+n]}
+		if e.Default != nil {
+			s.Default = children[1+n]
+		}
+		return s
+	case *Match:
+		n := len(e.Keys)
+		m := &Match{Expr: children[0], Keys: children[1 : 1+n : 1+n], Cases: children[1+n : 1+2*n : 1+2*n]}
+		if e.Default != nil {
+			m.Default = children[1+2*n]
+		}
+		return m
+	default:
+		panic(fmt.Sprintf("unknown expression %T", e))
+	}
+}
+
+// Walk calls fn for e and all of its subexpressions in pre-order. When fn returns false,
+// the subexpressions of the node are skipped.
+func Walk(e Expr, fn func(Expr) bool) {
+	if !fn(e) {
+		return
+	}
+	for _, child := range Children(e) {
+		Walk(child, fn)
+	}
+}
+
+// Rewrite rebuilds e bottom-up, fn gets each node after its children have been rewritten and
+// returns its replacement. Nodes whose children didn't change are not copied.
+func Rewrite(e Expr, fn func(Expr) Expr) Expr {
+	return fn(rewriteChildren(e, func(child Expr) Expr {
+		return Rewrite(child, fn)
+	}))
+}
+
+// RewriteTopDown rebuilds e top-down, fn gets each node before its children and the children
+// of the returned replacement are rewritten next.
+func RewriteTopDown(e Expr, fn func(Expr) Expr) Expr {
+	return rewriteChildren(fn(e), func(child Expr) Expr {
+		return RewriteTopDown(child, fn)
+	})
+}
+
+func rewriteChildren(e Expr, fn func(Expr) Expr) Expr {
+	children := Children(e)
+	if len(children) == 0 {
+		return e
+	}
+	changed := false
+	for i := range children {
+		child := fn(children[i])
+		if child != children[i] {
+			children[i] = child
+			changed = true
+		}
+	}
+	if !changed {
+		return e
+	}
+	return WithChildren(e, children)
+}
+
+// FreeVars returns the sorted names of the local variables occurring free in e.
+func FreeVars(e Expr) []string {
+	set := make(map[string]bool)
+	freeVars(e, nil, set)
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func freeVars(e Expr, bound []string, free map[string]bool) {
+	switch e := e.(type) {
+	case *Var:
+		if e.Index < 0 && !Contains(bound, e.Name) {
+			free[e.Name] = true
+		}
+	case *Abst:
+		freeVars(e.Body, extend(bound, e.Bound), free)
+	case *Let:
+		for _, value := range e.Values {
+			freeVars(value, bound, free)
+		}
+		freeVars(e.Body, extend(bound, e.Bound), free)
+	case *LetRec:
+		recBound := extend(bound, e.Bound)
+		for _, value := range e.Values {
+			freeVars(value, recBound, free)
+		}
+		freeVars(e.Body, recBound, free)
+	default:
+		for _, child := range Children(e) {
+			freeVars(child, bound, free)
+		}
+	}
+}
+
+// Contains tells whether the name is among the names.
+func Contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Subst simultaneously replaces the free occurrences of the local variables named in subst
+// with the corresponding expressions. Bound names that would capture free variables of the
+// substituted expressions are renamed.
+func Subst(e Expr, subst map[string]Expr) Expr {
+	if len(subst) == 0 {
+		return e
+	}
+	switch e := e.(type) {
+	case *Var:
+		if value, ok := subst[e.Name]; ok && e.Index < 0 {
+			return value
+		}
+		return e
+	case *Abst:
+		bound, body := substBinder(e.Bound, nil, e.Body, subst)
+		return &Abst{Bound: bound, Body: body[0]}
+	case *Let:
+		values := make([]Expr, len(e.Values))
+		for i := range values {
+			values[i] = Subst(e.Values[i], subst)
+		}
+		bound, body := substBinder(e.Bound, nil, e.Body, subst)
+		return &Let{Bound: bound, Values: values, Body: body[0]}
+	case *LetRec:
+		bound, exprs := substBinder(e.Bound, e.Values, e.Body, subst)
+		n := len(e.Values)
+		return &LetRec{Bound: bound, Values: exprs[:n], Body: exprs[n]}
+	default:
+		return rewriteChildren(e, func(child Expr) Expr {
+			return Subst(child, subst)
+		})
+	}
+}
+
+// substBinder substitutes in exprs and body under the bound names, renaming the bound names
+// that would capture. It returns the new bound names followed by the new exprs and body.
+func substBinder(bound []string, exprs []Expr, body Expr, subst map[string]Expr) ([]string, []Expr) {
+	scope := append(append([]Expr(nil), exprs...), body)
+
+	inner := make(map[string]Expr)
+	for name, value := range subst {
+		if !Contains(bound, name) {
+			inner[name] = value
+		}
+	}
+
+	captured := make(map[string]bool)
+	avoid := make(map[string]bool)
+	for _, value := range inner {
+		for _, name := range FreeVars(value) {
+			captured[name] = true
+			avoid[name] = true
+		}
+	}
+	for _, e := range scope {
+		for _, name := range FreeVars(e) {
+			avoid[name] = true
+		}
+	}
+	for _, name := range bound {
+		avoid[name] = true
+	}
+
+	newBound, renamed := bound, false
+	for i, name := range bound {
+		if !captured[name] {
+			continue
+		}
+		if !renamed {
+			newBound = append([]string(nil), bound...)
+			renamed = true
+		}
+		fresh := Fresh(name, avoid)
+		avoid[fresh] = true
+		newBound[i] = fresh
+		inner[name] = &Var{Name: fresh, Index: -1}
+	}
+
+	for i := range scope {
+		scope[i] = Subst(scope[i], inner)
+	}
+	return newBound, scope
+}
+
+// Fresh returns name with primes appended until it's not in avoid.
+func Fresh(name string, avoid map[string]bool) string {
+	for avoid[name] {
+		name += "'"
+	}
+	return name
+}
+
+// AlphaEqual tells whether a and b are equal up to the renaming of bound variables.
+// Annotations are ignored.
+func AlphaEqual(a, b Expr) bool {
+	return alphaEqual(a, b, nil, nil)
+}
+
+func alphaEqual(a, b Expr, boundA, boundB []string) bool {
+	a, b = Unannotate(a), Unannotate(b)
+	switch a := a.(type) {
+	case *Char:
+		b, ok := b.(*Char)
+		return ok && a.Value == b.Value
+	case *Int:
+		b, ok := b.(*Int)
+		return ok && a.Value.Cmp(&b.Value) == 0
+	case *Float:
+		b, ok := b.(*Float)
+		return ok && math.Float64bits(a.Value) == math.Float64bits(b.Value)
+	case *Operator:
+		b, ok := b.(*Operator)
+		return ok && a.Code == b.Code
+	case *Make:
+		b, ok := b.(*Make)
+		return ok && a.Index == b.Index
+	case *Field:
+		b, ok := b.(*Field)
+		return ok && a.Index == b.Index
+	case *Var:
+		b, ok := b.(*Var)
+		if !ok || a.Index != b.Index {
+			return false
+		}
+		if a.Index >= 0 {
+			return a.Name == b.Name
+		}
+		i, j := lastIndex(boundA, a.Name), lastIndex(boundB, b.Name)
+		if i < 0 && j < 0 {
+			return a.Name == b.Name
+		}
+		return i == j
+	case *Abst:
+		b, ok := b.(*Abst)
+		return ok && len(a.Bound) == len(b.Bound) &&
+			alphaEqual(a.Body, b.Body, extend(boundA, a.Bound), extend(boundB, b.Bound))
+	case *Appl:
+		b, ok := b.(*Appl)
+		return ok && alphaEqual(a.Rator, b.Rator, boundA, boundB) &&
+			alphaEqualAll(a.Rands, b.Rands, boundA, boundB)
+	case *Let:
+		b, ok := b.(*Let)
+		return ok && len(a.Bound) == len(b.Bound) &&
+			alphaEqualAll(a.Values, b.Values, boundA, boundB) &&
+			alphaEqual(a.Body, b.Body, extend(boundA, a.Bound), extend(boundB, b.Bound))
+	case *LetRec:
+		b, ok := b.(*LetRec)
+		if !ok || len(a.Bound) != len(b.Bound) {
+			return false
+		}
+		recA, recB := extend(boundA, a.Bound), extend(boundB, b.Bound)
+		return alphaEqualAll(a.Values, b.Values, recA, recB) && alphaEqual(a.Body, b.Body, recA, recB)
+	case *Strict:
+		b, ok := b.(*Strict)
+		return ok && alphaEqual(a.Expr, b.Expr, boundA, boundB)
+	case *Switch:
+		b, ok := b.(*Switch)
+		return ok && alphaEqual(a.Expr, b.Expr, boundA, boundB) &&
+			alphaEqualAll(a.Cases, b.Cases, boundA, boundB) &&
+			alphaEqualOptional(a.Default, b.Default, boundA, boundB)
+	case *Match:
+		b, ok := b.(*Match)
+		return ok && alphaEqual(a.Expr, b.Expr, boundA, boundB) &&
+			alphaEqualAll(a.Keys, b.Keys, boundA, boundB) &&
+			alphaEqualAll(a.Cases, b.Cases, boundA, boundB) &&
+			alphaEqualOptional(a.Default, b.Default, boundA, boundB)
+	default:
+		panic(fmt.Sprintf("unknown expression %T", a))
+	}
+}
+
+func alphaEqualAll(as, bs []Expr, boundA, boundB []string) bool {
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := range as {
+		if !alphaEqual(as[i], bs[i], boundA, boundB) {
+			return false
+		}
+	}
+	return true
+}
+
+func alphaEqualOptional(a, b Expr, boundA, boundB []string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return alphaEqual(a, b, boundA, boundB)
+}
+
+// Unannotate strips the annotations around e.
+func Unannotate(e Expr) Expr {
+	for {
+		a, ok := e.(*Annotated)
+		if !ok {
+			return e
+		}
+		e = a.Expr
+	}
+}
+
+func lastIndex(names []string, name string) int {
+	for i := len(names) - 1; i >= 0; i-- {
+		if names[i] == name {
+			return i
+		}
+	}
+	return -1
+}